@@ -2,83 +2,363 @@ package main
 
 import (
 	"errors"
+	"net"
 	"net/http"
+	"strings"
 
+	"./lockout"
 	"./model"
 	"./session"
+	"./setting"
 	"github.com/labstack/echo"
 )
 
 // auth.goが返すエラーの定義
 var (
-	ErrorInvalidUserID   = errors.New("Invalid UserID")
-	ErrorInvalidPassword = errors.New("Invalid Password")
-	ErrorNotLoggedIn     = errors.New("Not Logged In")
+	ErrorInvalidUserID          = errors.New("Invalid UserID")
+	ErrorInvalidPassword        = errors.New("Invalid Password")
+	ErrorNotLoggedIn            = errors.New("Not Logged In")
+	ErrorPasswordConflict       = errors.New("Password Changed Concurrently")
+	ErrorLoginLocked            = errors.New("Login Locked")
+	ErrorTOTPRequired           = errors.New("TOTP Required")
+	ErrorPasswordChangeRequired = errors.New("Password Change Required")
+	ErrorSessionLimit           = errors.New("Session Limit Exceeded")
+)
+
+// セッションデータのキー
+const (
+	sessionKeyUserID    = session.UserIDKey
+	sessionKeyAuthState = session.AuthStateKey
+)
+
+// ログインの認証状態
+const (
+	authStatePasswordVerified = "password-verified"            // パスワード確認済み（二段階認証のコード待ち）
+	authStateAuthenticated    = session.AuthStateAuthenticated // 認証済み
+	// パスワード変更待ち（パスワードを変更するまで他の画面は参照できない）
+	authStatePasswordChangeRequired = "password-change-required"
+)
+
+// 同時にログインできるセッション数の上限を超えた場合の動作
+const (
+	sessionLimitEvict  = "evict"  // 最も古いセッションを終了させる
+	sessionLimitRefuse = "refuse" // ログインを拒否する
 )
 
 // UserLogin はユーザーログイン時の処理を行います。
-func UserLogin(c echo.Context, userID string, password string) error {
+// ユーザーが存在しない場合も、パスワードが誤っている場合と同じ時間をかけて
+// 同じエラー（ErrorInvalidPassword）を返します。
+// ログインの失敗が続いたユーザーID・IPアドレスは一時的にロックし、
+// ErrorLoginLocked を返します。
+// 二段階認証を有効にしているユーザーの場合は、セッションを
+// パスワード確認済みの状態で作成して ErrorTOTPRequired を返します。
+// 続けて UserLoginTOTP でコードを確認するとログインが完了します。
+// 管理者によりパスワードの変更が求められている場合は、パスワード変更待ちの
+// 状態でセッションを作成して ErrorPasswordChangeRequired を返します。
+// ログインが完了する際に、同時にログインできるセッション数の上限を超える場合は、
+// 設定に従って最も古いセッションを終了させるか、ErrorSessionLimit を返します。
+// remember を指定すると、ログインの完了時にログインしたままにするトークンを発行します。
+func UserLogin(c echo.Context, userID string, password string, remember bool) error {
+	release, err := checkLoginLocked(c, userID)
+	if err != nil {
+		return err
+	}
+	defer release()
 	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err == model.ErrorNotFound {
+		model.VerifyDummyPassword(password)
+		failLogin(c, userID)
+		return ErrorInvalidPassword
+	}
 	if err != nil {
 		return err
 	}
 	user := &users[0]
-	encodePassword := model.EncodeStringMD5(password)
-	if user.Password != encodePassword {
+	if !user.Password.Verify(password) {
+		failLogin(c, userID)
 		return ErrorInvalidPassword
 	}
-	sessionID, err := sessionManager.Create()
+	// 二段階認証がある場合は、コードの確認が済むまで失敗回数をリセットしない
+	authState := authStateAuthenticated
+	if user.TOTPEnabled() {
+		authState = authStatePasswordVerified
+	} else {
+		userLimiter.Reset(userID)
+		if user.MustChangePassword {
+			authState = authStatePasswordChangeRequired
+		}
+	}
+	// 旧形式のハッシュで保存されている場合は、現在の形式で保存し直す
+	if user.Password.NeedsRehash() {
+		rehashUserPassword(c, user, password)
+	}
+	sessionRequest, err := startLoginSession(c)
 	if err != nil {
 		return err
 	}
-	err = session.WriteCookie(c, sessionID)
-	if err != nil {
+	sessionRequest.Clear()
+	sessionRequest.SetValue(sessionKeyUserID, userID)
+	if authState == authStateAuthenticated {
+		if err := authenticateSession(c, sessionRequest, user); err != nil {
+			return err
+		}
+		if remember {
+			if err := issueRememberToken(c, user); err != nil {
+				c.Echo().Logger.Debugf("User[%s] Remember Token Issue Error. [%s]", userID, err)
+			}
+		}
+		return nil
+	}
+	sessionRequest.SetValue(sessionKeyAuthState, authState)
+	// 二段階認証がある場合は、コードの確認後にトークンを発行する
+	if remember && authState == authStatePasswordVerified {
+		sessionRequest.SetValue(sessionKeyRememberMe, "1")
+	}
+	if err := sessionRequest.Save(); err != nil {
 		return err
 	}
-	sessionStore, err := sessionManager.LoadStore(sessionID)
-	if err != nil {
+	switch authState {
+	case authStatePasswordVerified:
+		return ErrorTOTPRequired
+	case authStatePasswordChangeRequired:
+		return ErrorPasswordChangeRequired
+	}
+
+	return nil
+}
+
+// ログイン用のセッションを用意する
+// ログイン前のセッションがある場合は、IDを再発行して引き継ぎ、
+// 無い場合（期限切れを含む）は新しく作成する
+func startLoginSession(c echo.Context) (*session.Request, error) {
+	sessionRequest := session.FromContext(c)
+	if sessionRequest.Valid() {
+		err := regenerateSession(c, sessionRequest)
+		if err == nil {
+			return sessionRequest, nil
+		}
+		c.Echo().Logger.Debugf("Login Session Regenerate Error. [%s]", err)
+	}
+	if err := sessionRequest.Create(); err != nil {
+		return sessionRequest, err
+	}
+	setSessionClient(c, sessionRequest.ID())
+	return sessionRequest, nil
+}
+
+// セッションIDとCSRFトークンを再発行してCookieに書き込む
+// （認証状態が変わる際に呼び出し、セッション固定攻撃を防ぐ）
+func regenerateSession(c echo.Context, sessionRequest *session.Request) error {
+	if err := sessionRequest.Regenerate(); err != nil {
 		return err
 	}
-	sessionData := map[string]string{
-		"user_id": userID,
+	if _, err := sessionRequest.RotateCSRFToken(); err != nil {
+		return err
+	}
+	setSessionClient(c, sessionRequest.ID())
+	return nil
+}
+
+// セッションの一覧に表示する接続元の情報を記録する
+// （セッションの一覧を持たない Provider の場合は何もしない）
+func setSessionClient(c echo.Context, sessionID session.ID) {
+	err := sessionManager.SetClient(sessionID, clientIP(c), c.Request().UserAgent())
+	if err != nil && err != session.ErrorNotImplemented {
+		c.Echo().Logger.Debugf("Session Client Error. [%s]", err)
+	}
+}
+
+// セッションをログインが完了した状態にする
+// 同時にログインできるセッション数の上限を超える場合は、設定に従って古いセッションを
+// 終了させるか、ログイン情報を消去して ErrorSessionLimit を返す
+// （上限の確認とログインの完了は、他のログインと競合しないようセッション管理の中でまとめて行う）
+func authenticateSession(c echo.Context, sessionRequest *session.Request, user *model.User) error {
+	evict := setting.Login.SessionLimit != sessionLimitRefuse
+	evicted, err := sessionRequest.Authenticate(user.UserID, maxSessions(user), evict)
+	if err == session.ErrorLimitExceeded {
+		sessionRequest.Clear()
+		return ErrorSessionLimit
 	}
-	sessionStore.Data = sessionData
-	err = sessionManager.SaveStore(sessionID, sessionStore)
 	if err != nil {
 		return err
 	}
-
+	for _, x := range evicted {
+		c.Echo().Logger.Infof("User[%s] Session Evicted. created[%s]", user.UserID, x.Created)
+	}
 	return nil
 }
 
+// ユーザーが同時にログインできるセッション数の上限（0の場合は無制限）
+func maxSessions(user *model.User) int {
+	limit := 0
+	for _, role := range user.Roles {
+		n := setting.Login.MaxSessions[string(role)]
+		if n > 0 && (limit == 0 || n < limit) {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// 接続元のIPアドレスを返す
+// X-Forwarded-For ヘッダーは偽装できるため、信頼するプロキシからの接続の場合のみ参照し、
+// 右から順に見て信頼するプロキシ以外の最初のアドレスを接続元とする
+func clientIP(c echo.Context) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(req.Header[echo.HeaderXForwardedFor], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		x := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(x) == nil {
+			break
+		}
+		ip = x
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// 信頼するプロキシ（setting.Server.TrustedProxies）のIPアドレスか
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, x := range setting.Server.TrustedProxies {
+		if _, network, err := net.ParseCIDR(x); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if proxy := net.ParseIP(x); proxy != nil && proxy.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ユーザーID・IPアドレスがロックされていないか確認し、試行を予約する
+// 予約した試行を解放する関数を返すので、試行の終了時に必ず呼び出す
+func checkLoginLocked(c echo.Context, userID string) (func(), error) {
+	if _, err := userLimiter.Check(userID); err != nil {
+		if err == lockout.ErrorLocked {
+			return nil, ErrorLoginLocked
+		}
+		return nil, err
+	}
+	ip := clientIP(c)
+	if _, err := ipLimiter.Check(ip); err != nil {
+		userLimiter.Release(userID)
+		if err == lockout.ErrorLocked {
+			return nil, ErrorLoginLocked
+		}
+		return nil, err
+	}
+	release := func() {
+		userLimiter.Release(userID)
+		ipLimiter.Release(ip)
+	}
+	return release, nil
+}
+
+// ユーザーID・IPアドレスのログイン失敗回数を加算する
+// （存在しないユーザーIDも数えることで、ロックの有無からユーザーの存在が分からないようにする）
+func failLogin(c echo.Context, userID string) {
+	if _, err := userLimiter.Fail(userID); err != nil {
+		c.Echo().Logger.Debugf("User[%s] Login Fail Count Error. [%s]", userID, err)
+	}
+	ip := clientIP(c)
+	if _, err := ipLimiter.Fail(ip); err != nil {
+		c.Echo().Logger.Debugf("IP[%s] Login Fail Count Error. [%s]", ip, err)
+	}
+}
+
+// パスワードを現在の形式でハッシュ化し直して保存する
+// （失敗してもログイン自体は成功させる）
+func rehashUserPassword(c echo.Context, user *model.User, password string) {
+	hash, err := model.HashPassword(password)
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] Password Rehash Error. [%s]", user.UserID, err)
+		return
+	}
+	oldHash := user.Password
+	_, err = userDA.Modify(user.ID, func(u *model.User) error {
+		// 確認した後に他のリクエストでパスワードが変更された場合は上書きしない
+		if u.Password != oldHash {
+			return ErrorPasswordConflict
+		}
+		u.Password = hash
+		return nil
+	})
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] Password Rehash Error. [%s]", user.UserID, err)
+		return
+	}
+	c.Echo().Logger.Debugf("User[%s] Password Rehashed.", user.UserID)
+}
+
 // UserLogout はユーザーログアウト時の処理を行います。
+// セッションIDを再発行してログイン情報を消去し、ログアウト前のIDは無効にします。
+// セッションが既に期限切れの場合は、ブラウザのCookieを削除します。
+// ログインしたままにするトークンも無効にします。
 func UserLogout(c echo.Context) error {
-	sessionID, err := session.ReadCookie(c)
+	forgetRememberToken(c)
+	sessionRequest, err := loadSession(c)
+	if err == nil {
+		err = regenerateSession(c, sessionRequest)
+	}
 	if err != nil {
+		if err := session.DeleteCookie(c); err != nil {
+			return err
+		}
 		return err
 	}
-	err = sessionManager.Delete(sessionID)
-	if err != nil {
+	sessionRequest.Clear()
+	if err := sessionRequest.Save(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// リクエストのセッションを返す（有効なセッションが無い場合は ErrorNotLoggedIn）
+func loadSession(c echo.Context) (*session.Request, error) {
+	sessionRequest := session.FromContext(c)
+	if !sessionRequest.Valid() {
+		return sessionRequest, ErrorNotLoggedIn
+	}
+	return sessionRequest, nil
+}
+
+// ログインが完了しているセッションのユーザーIDを返す
+func authenticatedUserID(sessionRequest *session.Request) (string, error) {
+	sessionUserID, ok := sessionRequest.Value(sessionKeyUserID)
+	if !ok {
+		return "", ErrorNotLoggedIn
+	}
+	if authState, _ := sessionRequest.Value(sessionKeyAuthState); authState != authStateAuthenticated {
+		return "", ErrorNotLoggedIn
+	}
+	return sessionUserID, nil
+}
+
 // CheckUserID は指定されたユーザーIDでログインしているか確認します。
 func CheckUserID(c echo.Context, userID string) error {
-	sessionID, err := session.ReadCookie(c)
+	sessionRequest, err := loadSession(c)
 	if err != nil {
 		return err
 	}
-	sessionStore, err := sessionManager.LoadStore(sessionID)
+	sessionUserID, err := authenticatedUserID(sessionRequest)
 	if err != nil {
 		return err
 	}
-	sessionUserID, ok := sessionStore.Data["user_id"]
-	if !ok {
-		return ErrorNotLoggedIn
-	}
 	if sessionUserID != userID {
 		return ErrorInvalidUserID
 	}
@@ -88,18 +368,14 @@ func CheckUserID(c echo.Context, userID string) error {
 
 // CheckRole は指定された権限を持ったユーザーでログインしているか確認します。
 func CheckRole(c echo.Context, role model.Role) (bool, error) {
-	sessionID, err := session.ReadCookie(c)
+	sessionRequest, err := loadSession(c)
 	if err != nil {
 		return false, err
 	}
-	sessionStore, err := sessionManager.LoadStore(sessionID)
+	sessionUserID, err := authenticatedUserID(sessionRequest)
 	if err != nil {
 		return false, err
 	}
-	sessionUserID, ok := sessionStore.Data["user_id"]
-	if !ok {
-		return false, ErrorNotLoggedIn
-	}
 	haveRole, err := CheckRoleByUserID(sessionUserID, role)
 	return haveRole, nil
 }
@@ -111,13 +387,7 @@ func CheckRoleByUserID(userID string, role model.Role) (bool, error) {
 		return false, err
 	}
 	user := &users[0]
-	for _, v := range user.Roles {
-		if v == role {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return user.HasRole(role), nil
 }
 
 // MiddlewareAuthAdmin は管理者権限を持ったユーザーのみが参照できる
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+
+	"./model"
+	"github.com/labstack/echo"
+)
+
+// auth_password.goが返すエラーの定義
+var (
+	ErrorPasswordUnchanged = errors.New("Password Unchanged")
+)
+
+// CheckPasswordChangeUser は指定されたユーザーIDでログインしていて、
+// パスワードを変更できる状態か確認します。
+// パスワード変更待ちの状態のセッションも受け付けます。
+func CheckPasswordChangeUser(c echo.Context, userID string) error {
+	sessionRequest, err := loadSession(c)
+	if err != nil {
+		return err
+	}
+	sessionUserID, ok := sessionRequest.Value(sessionKeyUserID)
+	if !ok {
+		return ErrorNotLoggedIn
+	}
+	authState, _ := sessionRequest.Value(sessionKeyAuthState)
+	if authState != authStateAuthenticated && authState != authStatePasswordChangeRequired {
+		return ErrorNotLoggedIn
+	}
+	if sessionUserID != userID {
+		return ErrorInvalidUserID
+	}
+
+	return nil
+}
+
+// ChangePassword は現在のパスワードを確認してパスワードを変更します。
+// 変更後はセッションIDを再発行し、他の端末のセッションとログインしたままにする
+// トークンは全て無効にします。
+// パスワード変更待ちの状態のセッションは、変更が済むとログイン完了の状態になります。
+func ChangePassword(c echo.Context, userID string, currentPassword string, newPassword string) error {
+	if err := CheckPasswordChangeUser(c, userID); err != nil {
+		return err
+	}
+	// 現在のパスワードの総当たりを防ぐため、ログインと同じ試行回数制限を適用する
+	release, err := checkLoginLocked(c, userID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return err
+	}
+	user := &users[0]
+	if !user.Password.Verify(currentPassword) {
+		failLogin(c, userID)
+		return ErrorInvalidPassword
+	}
+	if newPassword == currentPassword {
+		return ErrorPasswordUnchanged
+	}
+	if err := model.CheckPasswordPolicy(userID, newPassword); err != nil {
+		return err
+	}
+	hash, err := model.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	oldHash := user.Password
+	_, err = userDA.Modify(user.ID, func(u *model.User) error {
+		// 確認した後に他のリクエストでパスワードが変更された場合は上書きしない
+		if u.Password != oldHash {
+			return ErrorPasswordConflict
+		}
+		u.Password = hash
+		u.MustChangePassword = false
+		u.RememberTokens = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Echo().Logger.Infof("User[%s] Password Changed.", userID)
+
+	// パスワードの変更後は、セッションIDを再発行する
+	sessionRequest, err := loadSession(c)
+	if err != nil {
+		return err
+	}
+	if err := regenerateSession(c, sessionRequest); err != nil {
+		return err
+	}
+	if err := sessionRequest.Save(); err != nil {
+		return err
+	}
+	if err := sessionManager.DeleteAllExceptCurrent(userID, sessionRequest.ID()); err != nil {
+		return err
+	}
+	if authState, _ := sessionRequest.Value(sessionKeyAuthState); authState == authStatePasswordChangeRequired {
+		if err := authenticateSession(c, sessionRequest, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RequirePasswordChange は次回ログイン時にパスワードの変更を求めるよう設定します。
+// ログイン中のユーザーのセッションは全て終了させます。
+func RequirePasswordChange(userID string) error {
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return err
+	}
+	_, err = userDA.Modify(users[0].ID, func(u *model.User) error {
+		u.MustChangePassword = true
+		// ログインしたままにするトークンでパスワードの変更を回避させない
+		u.RememberTokens = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return sessionManager.DeleteByUser(userID)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"./model"
+	"./session"
+	"./setting"
+	"github.com/labstack/echo"
+)
+
+// auth_remember.goが返すエラーの定義
+var (
+	ErrorInvalidRememberCookie = errors.New("Invalid Remember Cookie")
+)
+
+// 二段階認証の完了後にログインしたままにするトークンを発行するかを保存するセッションデータのキー
+const sessionKeyRememberMe = "remember_me"
+
+// ログインしたままにするトークンを発行し、Cookieに書き込む
+func issueRememberToken(c echo.Context, user *model.User) error {
+	expire := time.Now().Add(setting.Login.RememberExpire)
+	family, validator, err := userDA.IssueRememberToken(user.ID, expire)
+	if err != nil {
+		return err
+	}
+	writeRememberCookie(c, user.ID, family, validator, expire)
+	return nil
+}
+
+// ログアウト時に、ログインしたままにするトークンを無効にしてCookieを削除する
+func forgetRememberToken(c echo.Context) {
+	id, family, _, err := readRememberCookie(c)
+	if err != nil {
+		return
+	}
+	deleteRememberCookie(c)
+	if err := userDA.RevokeRememberToken(id, family); err != nil {
+		c.Echo().Logger.Debugf("User[ID=%s] Remember Token Revoke Error. [%s]", id, err)
+	}
+}
+
+// MiddlewareRememberLogin は、ログインしていないブラウザがログインしたままにする
+// トークンを持っている場合に、新しいセッションを作成してログインさせるMiddlewareです。
+// 作成したセッションのCookieを反映させるため、同じURLにリダイレクトします。
+// ログインするとCSRFトークンが変わるため、GET・HEAD のリクエストの場合のみ行います。
+func MiddlewareRememberLogin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if method := c.Request().Method; method != http.MethodGet && method != http.MethodHead {
+			return next(c)
+		}
+		id, family, validator, err := readRememberCookie(c)
+		if err != nil {
+			return next(c)
+		}
+		// ログイン中（二段階認証などの途中を含む）のセッションがある場合は何もしない
+		if sessionRequest, err := loadSession(c); err == nil {
+			if _, ok := sessionRequest.Value(sessionKeyUserID); ok {
+				return next(c)
+			}
+		}
+		err = rememberLogin(c, id, family, validator)
+		if err != nil {
+			c.Echo().Logger.Debugf("User[ID=%s] Remember Login Error. [%s]", id, err)
+			// 同時に送られたリクエストで置き換え済みの場合や、セッション数の上限で
+			// ログインできなかった場合は、有効なCookieを消さないようにする
+			if err != model.ErrorRememberTokenRotated && err != ErrorSessionLimit {
+				deleteRememberCookie(c)
+			}
+			return next(c)
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, c.Request().URL.RequestURI())
+	}
+}
+
+// ログインしたままにするトークンでログインする
+func rememberLogin(c echo.Context, id model.ID, family string, validator string) error {
+	expire := time.Now().Add(setting.Login.RememberExpire)
+	user, newValidator, err := userDA.RotateRememberToken(id, family, validator, expire)
+	if err != nil {
+		return err
+	}
+	writeRememberCookie(c, user.ID, family, newValidator, expire)
+	if user.MustChangePassword {
+		return ErrorPasswordChangeRequired
+	}
+	sessionRequest, err := startLoginSession(c)
+	if err != nil {
+		return err
+	}
+	sessionRequest.Clear()
+	if err := authenticateSession(c, sessionRequest, &user); err != nil {
+		return err
+	}
+	c.Echo().Logger.Debugf("User[%s] Remember Login.", user.UserID)
+	return nil
+}
+
+// Cookieの値は「ユーザーのID:系列:検証値」の形式
+func writeRememberCookie(c echo.Context, id model.ID, family string, validator string, expire time.Time) {
+	cookie := session.NewCookie(setting.Login.RememberCookie)
+	cookie.Value = strings.Join([]string{string(id), family, validator}, ":")
+	cookie.Expires = expire
+	c.SetCookie(cookie)
+}
+
+func readRememberCookie(c echo.Context) (model.ID, string, string, error) {
+	cookie, err := c.Cookie(session.CookieName(setting.Login.RememberCookie))
+	if err != nil {
+		return "", "", "", err
+	}
+	parts := strings.Split(cookie.Value, ":")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", ErrorInvalidRememberCookie
+	}
+	return model.ID(parts[0]), parts[1], parts[2], nil
+}
+
+func deleteRememberCookie(c echo.Context) {
+	cookie := session.NewCookie(setting.Login.RememberCookie)
+	cookie.Value = ""
+	cookie.Expires = time.Unix(0, 0)
+	cookie.MaxAge = -1
+	c.SetCookie(cookie)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"./lockout"
+	"./model"
+	"./setting"
+	"github.com/labstack/echo"
+)
+
+// 存在しないユーザーIDでログインした場合も、パスワードが誤っている場合と
+// 同じだけパスワードの検証に時間をかけることを確認する
+func TestUserLoginUnknownUserTakesComparableTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := model.HashPassword("correct password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []model.User{{ID: "1", UserID: "alice", Password: hash, Roles: []model.Role{model.RoleUser}}}
+	bytes, err := json.Marshal(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting.UserData.Backend = "json"
+	setting.UserData.FilePath = filepath.Join(dir, "users.json")
+	setting.UserData.BackupCount = 0
+	if err := ioutil.WriteFile(setting.UserData.FilePath, bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	userDA = &model.UserDataAccessor{}
+	if err := userDA.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	defer userDA.Stop()
+	// 計測中にロックされないよう、失敗回数の上限を大きくする
+	config := lockout.Config{
+		MaxFailures:   1000,
+		BaseDuration:  time.Minute,
+		MaxDuration:   time.Minute,
+		FailureWindow: time.Minute,
+	}
+	userLimiter = &lockout.Limiter{}
+	userLimiter.Start(e, config)
+	defer userLimiter.Stop()
+	ipLimiter = &lockout.Limiter{}
+	ipLimiter.Start(e, config)
+	defer ipLimiter.Stop()
+
+	login := func(userID string) time.Duration {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		c := e.NewContext(req, httptest.NewRecorder())
+		start := time.Now()
+		err := UserLogin(c, userID, "wrong password", false)
+		elapsed := time.Since(start)
+		if err != ErrorInvalidPassword {
+			t.Fatalf("UserLogin(%s) = %v, want ErrorInvalidPassword", userID, err)
+		}
+		return elapsed
+	}
+	// 存在しないユーザーでの最初のログインも遅れずに応答すること
+	first := login("nobody")
+	// 計測のばらつきを抑えるため、数回のうち最も短い時間で比べる
+	fastest := func(userID string) time.Duration {
+		var min time.Duration
+		for i := 0; i < 5; i++ {
+			if d := login(userID); i == 0 || d < min {
+				min = d
+			}
+		}
+		return min
+	}
+	known := fastest("alice")
+	unknown := fastest("nobody")
+	if unknown < known/2 || unknown > known*2 {
+		t.Fatalf("unknown user took %s, existing user took %s", unknown, known)
+	}
+	if first > known*2 {
+		t.Fatalf("first unknown user login took %s, existing user took %s", first, known)
+	}
+}
+
+// X-Forwarded-For ヘッダーは信頼するプロキシからの接続の場合のみ参照することを確認する
+func TestClientIP(t *testing.T) {
+	setting.Server.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	defer func() { setting.Server.TrustedProxies = nil }()
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "1.2.3.4, 198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"192.168.1.1:1234", "", "192.168.1.1"},
+	}
+	e := echo.New()
+	for _, x := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = x.remoteAddr
+		if x.forwarded != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, x.forwarded)
+		}
+		c := e.NewContext(req, httptest.NewRecorder())
+		if got := clientIP(c); got != x.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", x.remoteAddr, x.forwarded, got, x.want)
+		}
+	}
+}
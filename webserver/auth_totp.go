@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"./model"
+	"./session"
+	"./setting"
+	"github.com/labstack/echo"
+)
+
+// auth_totp.goが返すエラーの定義
+var (
+	ErrorInvalidTOTPCode   = errors.New("Invalid TOTP Code")
+	ErrorTOTPNotEnrolling  = errors.New("TOTP Not Enrolling")
+	ErrorTOTPAlreadyActive = errors.New("TOTP Already Active")
+)
+
+// 登録途中のTOTPシークレットを保存するセッションデータのキー
+const sessionKeyTOTPPendingSecret = "totp_pending_secret"
+
+// UserLoginTOTP は二段階認証のコードを確認してログインを完了します。
+// リカバリーコードも受け付け、使用したリカバリーコードは無効にします。
+// ログインしたユーザーIDを返します。パスワードの変更が求められている場合は
+// ユーザーIDと共に ErrorPasswordChangeRequired を返します。
+// 同時にログインできるセッション数の上限は UserLogin と同様に適用します。
+func UserLoginTOTP(c echo.Context, code string) (string, error) {
+	sessionRequest, err := loadSession(c)
+	if err != nil {
+		return "", err
+	}
+	userID, ok := sessionRequest.Value(sessionKeyUserID)
+	if authState, _ := sessionRequest.Value(sessionKeyAuthState); !ok || authState != authStatePasswordVerified {
+		return "", ErrorNotLoggedIn
+	}
+	release, err := checkLoginLocked(c, userID)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return "", err
+	}
+	user := &users[0]
+	// 同じコードを再利用できないよう、使用したステップ・リカバリーコードを
+	// 他のリクエストと競合しないように記録する
+	step, ok := model.VerifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if ok {
+		err = userDA.ConsumeTOTPStep(user.ID, step)
+	} else {
+		err = userDA.ConsumeRecoveryCode(*user, code)
+	}
+	if err == model.ErrorTOTPCodeUsed || err == model.ErrorRecoveryCodeInvalid {
+		failLogin(c, userID)
+		return "", ErrorInvalidTOTPCode
+	}
+	if err != nil {
+		return "", err
+	}
+	userLimiter.Reset(userID)
+	// 認証状態が変わるため、セッションIDを再発行する
+	if err := regenerateSession(c, sessionRequest); err != nil {
+		return "", err
+	}
+	rememberMe, _ := sessionRequest.Value(sessionKeyRememberMe)
+	remember := rememberMe == "1"
+	sessionRequest.DeleteValue(sessionKeyRememberMe)
+	if user.MustChangePassword {
+		sessionRequest.SetValue(sessionKeyAuthState, authStatePasswordChangeRequired)
+		if err := sessionRequest.Save(); err != nil {
+			return "", err
+		}
+		return userID, ErrorPasswordChangeRequired
+	}
+	if err := authenticateSession(c, sessionRequest, user); err != nil {
+		return "", err
+	}
+	if remember {
+		if err := issueRememberToken(c, user); err != nil {
+			c.Echo().Logger.Debugf("User[%s] Remember Token Issue Error. [%s]", userID, err)
+		}
+	}
+
+	return userID, nil
+}
+
+// BeginTOTPEnrollment は二段階認証の登録を開始し、認証アプリに登録する
+// シークレットを返します。シークレットは確認が済むまでセッションに保存します。
+func BeginTOTPEnrollment(c echo.Context, userID string) (string, error) {
+	if err := CheckUserID(c, userID); err != nil {
+		return "", err
+	}
+	sessionRequest := session.FromContext(c)
+	// 画面を再表示しても同じシークレットを使い続ける
+	if pending, ok := sessionRequest.Value(sessionKeyTOTPPendingSecret); ok {
+		return pending, nil
+	}
+	secret, err := model.GenerateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	sessionRequest.SetValue(sessionKeyTOTPPendingSecret, secret)
+
+	return secret, nil
+}
+
+// ConfirmTOTPEnrollment は認証アプリのコードを確認して二段階認証を有効にし、
+// リカバリーコードを返します。リカバリーコードはこの時にしか表示できません。
+func ConfirmTOTPEnrollment(c echo.Context, userID string, code string) ([]string, error) {
+	if err := CheckUserID(c, userID); err != nil {
+		return nil, err
+	}
+	sessionRequest, err := loadSession(c)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := sessionRequest.Value(sessionKeyTOTPPendingSecret)
+	if !ok {
+		return nil, ErrorTOTPNotEnrolling
+	}
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return nil, err
+	}
+	user := &users[0]
+	if user.TOTPEnabled() {
+		return nil, ErrorTOTPAlreadyActive
+	}
+	step, ok := model.VerifyTOTP(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrorInvalidTOTPCode
+	}
+	codes, hashes, err := model.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = userDA.Modify(user.ID, func(u *model.User) error {
+		// 同時に送られたリクエストで有効になっている場合は上書きしない
+		if u.TOTPEnabled() {
+			return ErrorTOTPAlreadyActive
+		}
+		u.TOTPSecret = secret
+		u.TOTPLastStep = step
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessionRequest.DeleteValue(sessionKeyTOTPPendingSecret)
+
+	return codes, nil
+}
+
+// DisableTOTP はパスワードを確認して二段階認証を無効にします。
+// パスワードの総当たりを防ぐため、ログインと同じ試行回数制限を適用します。
+func DisableTOTP(c echo.Context, userID string, password string) error {
+	if err := CheckUserID(c, userID); err != nil {
+		return err
+	}
+	release, err := checkLoginLocked(c, userID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return err
+	}
+	user := &users[0]
+	if !user.Password.Verify(password) {
+		failLogin(c, userID)
+		return ErrorInvalidPassword
+	}
+	_, err = userDA.Modify(user.ID, func(u *model.User) error {
+		u.TOTPSecret = ""
+		u.TOTPLastStep = 0
+		u.RecoveryCodes = nil
+		return nil
+	})
+	return err
+}
+
+// TOTPProvisioningURI は認証アプリに登録するためのURIを返します。
+func TOTPProvisioningURI(userID string, secret string) string {
+	return model.TOTPProvisioningURI(setting.Login.TOTPIssuer, userID, secret)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"./session"
+	"github.com/labstack/echo"
+)
+
+// CSRFトークンを送信するフォームの項目名
+const csrfFormField = "csrf_token"
+
+// MiddlewareCSRF は、GET・HEAD・OPTIONS 以外のリクエストに、セッションの
+// CSRFトークンが含まれているか確認するMiddlewareです。
+// トークンはフォームの項目（csrf_token）か、X-CSRF-Tokenヘッダで受け付けます。
+// ログイン前のフォームも、匿名のセッションのトークンで確認します。
+func MiddlewareCSRF(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		token := c.FormValue(csrfFormField)
+		if token == "" {
+			token = c.Request().Header.Get(echo.HeaderXCSRFToken)
+		}
+		if !session.FromContext(c).VerifyCSRFToken(token) {
+			c.Echo().Logger.Debugf("CSRF Token Error. [%s %s]", c.Request().Method, c.Request().URL.Path)
+			msg := "画面の有効期限が切れました。もう一度やり直してください。"
+			return c.Render(http.StatusForbidden, "error", msg)
+		}
+		return next(c)
+	}
+}
+
+// フォームに埋め込むCSRFトークンの hidden 項目を返す
+func csrfField(c echo.Context) (template.HTML, error) {
+	token, err := session.FromContext(c).CSRFToken()
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` +
+		template.HTMLEscapeString(token) + `" />`), nil
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"encoding/base64"
+	"html/template"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"./model"
+	"./session"
+	"./setting"
 
 	"github.com/labstack/echo"
+	qrcode "github.com/skip2/go-qrcode"
 )
 
 // ルーティングに対応するハンドラを設定します。
@@ -13,15 +21,29 @@ func setRoute(e *echo.Echo) {
 	e.GET("/", handleIndexGet)
 	e.GET("/login", handleLoginGet)
 	e.POST("/login", handleLoginPost)
+	e.GET("/login/totp", handleLoginTOTPGet)
+	e.POST("/login/totp", handleLoginTOTPPost)
 	e.POST("/logout", handleLogoutPost)
-	e.GET("/users/:user_id", handleUsers)
-	e.POST("/users/:user_id", handleUsers)
+	e.GET("/users/:user_id", handleUsersGet)
+	e.GET("/users/:user_id/totp", handleUserTOTPGet)
+	e.POST("/users/:user_id/totp", handleUserTOTPPost)
+	e.POST("/users/:user_id/totp/disable", handleUserTOTPDisablePost)
+	e.GET("/users/:user_id/password", handleUserPasswordGet)
+	e.POST("/users/:user_id/password", handleUserPasswordPost)
+	e.POST("/users/:user_id/sessions/delete_others", handleUserSessionsDeleteOthersPost)
+	e.POST("/users/:user_id/sessions/:key/delete", handleUserSessionDeletePost)
 
 	// 管理者のみが参照できるページ
 	admin := e.Group("/admin", MiddlewareAuthAdmin)
-	admin.GET("", handleAdmin)
-	admin.POST("", handleAdmin)
+	admin.GET("", handleAdminGet)
 	admin.GET("/users", handleAdminUsersGet)
+	admin.POST("/users/:user_id/unlock", handleAdminUserUnlockPost)
+	admin.POST("/users/:user_id/reset", handleAdminUserResetPost)
+	admin.GET("/sessions", handleAdminSessionsGet)
+	admin.POST("/sessions/:key/delete", handleAdminSessionDeletePost)
+	admin.GET("/users/:user_id/sessions", handleAdminUserSessionsGet)
+	admin.POST("/users/:user_id/sessions/delete", handleAdminUserSessionsDeletePost)
+	admin.POST("/users/:user_id/sessions/:key/delete", handleAdminUserSessionDeletePost)
 }
 
 // GET:/
@@ -30,8 +52,7 @@ func handleIndexGet(c echo.Context) error {
 }
 
 // GET:/users/:user_id
-// POST:/users/:user_id
-func handleUsers(c echo.Context) error {
+func handleUsersGet(c echo.Context) error {
 	userID := c.Param("user_id")
 	err := CheckUserID(c, userID)
 	if err != nil {
@@ -43,23 +64,239 @@ func handleUsers(c echo.Context) error {
 	if err != nil {
 		return c.Render(http.StatusOK, "error", err)
 	}
-	user := users[0]
-	return c.Render(http.StatusOK, "user", user)
+	data := userPage{User: users[0]}
+	if sessionRequest, err := loadSession(c); err == nil {
+		data.SessionExpire = sessionRequest.Expire()
+		data.SessionExpireSoon = sessionRequest.ExpiresWithin(setting.Session.ExpireWarning)
+		data.CurrentSessionKey = session.KeyOf(sessionRequest.ID())
+	}
+	sessions, err := sessionManager.ListByUser(userID)
+	if err == nil {
+		data.Sessions = sessions
+	}
+	return c.Render(http.StatusOK, "user", data)
+}
+
+// POST:/users/:user_id/sessions/:key/delete
+func handleUserSessionDeletePost(c echo.Context) error {
+	userID := c.Param("user_id")
+	if err := CheckUserID(c, userID); err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "ログインしていません。"
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	if err := sessionManager.DeleteByKey(userID, c.Param("key")); err != nil {
+		c.Echo().Logger.Debugf("User[%s] Session Delete Error. [%s]", userID, err)
+	}
+	return c.Redirect(http.StatusSeeOther, "/users/"+userID)
+}
+
+// POST:/users/:user_id/sessions/delete_others
+func handleUserSessionsDeleteOthersPost(c echo.Context) error {
+	userID := c.Param("user_id")
+	if err := CheckUserID(c, userID); err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "ログインしていません。"
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	sessionRequest := session.FromContext(c)
+	if err := sessionManager.DeleteAllExceptCurrent(userID, sessionRequest.ID()); err != nil {
+		c.Echo().Logger.Debugf("User[%s] Session Delete Error. [%s]", userID, err)
+	}
+	return c.Redirect(http.StatusSeeOther, "/users/"+userID)
+}
+
+// ユーザー画面に渡すデータ
+type userPage struct {
+	model.User
+	SessionExpire     time.Time
+	SessionExpireSoon bool
+	Sessions          []session.Info
+	CurrentSessionKey string
 }
 
 // GET:/admin
-// POST:/admin
-func handleAdmin(c echo.Context) error {
+func handleAdminGet(c echo.Context) error {
 	return c.Render(http.StatusOK, "admin", nil)
 }
 
+// ユーザー一覧画面の1ページあたりの表示件数
+const adminUsersPerPage = 20
+
+// ユーザー一覧画面に渡すデータ
+type adminUsersPage struct {
+	Users   []model.User
+	Total   int
+	Role    string
+	Keyword string
+	Sort    string
+	Desc    bool
+	Page    int
+	Pages   []int
+	Locked  map[string]time.Time
+}
+
+// クエリパラメータのページ番号を返す
+// 範囲外の値は、表示位置の計算が桁あふれしない範囲に丸める
+func pageParam(c echo.Context, perPage int) int {
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	if maxPage := math.MaxInt32 / perPage; page > maxPage {
+		return maxPage
+	}
+	return page
+}
+
 // GET:/admin/users
 func handleAdminUsersGet(c echo.Context) error {
-	users, err := userDA.FindAll()
+	page := pageParam(c, adminUsersPerPage)
+	query := model.UserQuery{
+		Role:    model.Role(c.QueryParam("role")),
+		Keyword: c.QueryParam("q"),
+		SortBy:  model.UserSortKey(c.QueryParam("sort")),
+		Desc:    c.QueryParam("desc") == "1",
+		Offset:  (page - 1) * adminUsersPerPage,
+		Limit:   adminUsersPerPage,
+	}
+	if query.SortBy != model.SortByFullName {
+		query.SortBy = model.SortByUserID
+	}
+	result, err := userDA.Find(query)
 	if err != nil {
 		return c.Render(http.StatusOK, "error", err)
 	}
-	return c.Render(http.StatusOK, "admin_users", users)
+	data := adminUsersPage{
+		Users:   result.Users,
+		Total:   result.Total,
+		Role:    string(query.Role),
+		Keyword: query.Keyword,
+		Sort:    string(query.SortBy),
+		Desc:    query.Desc,
+		Page:    page,
+	}
+	for i := 1; (i-1)*adminUsersPerPage < result.Total; i++ {
+		data.Pages = append(data.Pages, i)
+	}
+	// ログインがロックされているユーザー
+	locked, err := userLimiter.ListLocked()
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	data.Locked = make(map[string]time.Time)
+	for _, x := range locked {
+		data.Locked[x.Key] = x.LockedUntil
+	}
+	return c.Render(http.StatusOK, "admin_users", data)
+}
+
+// POST:/admin/users/:user_id/reset
+func handleAdminUserResetPost(c echo.Context) error {
+	userID := c.Param("user_id")
+	if err := RequirePasswordChange(userID); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[%s] Password Reset Required.", userID)
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+// POST:/admin/users/:user_id/unlock
+func handleAdminUserUnlockPost(c echo.Context) error {
+	userID := c.Param("user_id")
+	if err := userLimiter.Reset(userID); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[%s] Login Unlocked.", userID)
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+// セッション一覧画面の1ページあたりの表示件数
+const adminSessionsPerPage = 50
+
+// セッション一覧画面に渡すデータ
+type adminSessionsPage struct {
+	Sessions []session.Info
+	Total    int
+	UserID   string
+	IP       string
+	All      bool
+	Page     int
+	Pages    []int
+}
+
+// GET:/admin/sessions
+func handleAdminSessionsGet(c echo.Context) error {
+	page := pageParam(c, adminSessionsPerPage)
+	query := session.ListQuery{
+		UserID:       c.QueryParam("user_id"),
+		IP:           c.QueryParam("ip"),
+		LoggedInOnly: c.QueryParam("all") != "1",
+		Offset:       (page - 1) * adminSessionsPerPage,
+		Limit:        adminSessionsPerPage,
+	}
+	result, err := sessionManager.List(query)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	data := adminSessionsPage{
+		Sessions: result.Sessions,
+		Total:    result.Total,
+		UserID:   query.UserID,
+		IP:       query.IP,
+		All:      !query.LoggedInOnly,
+		Page:     page,
+	}
+	for i := 1; (i-1)*adminSessionsPerPage < result.Total; i++ {
+		data.Pages = append(data.Pages, i)
+	}
+	return c.Render(http.StatusOK, "admin_sessions", data)
+}
+
+// POST:/admin/sessions/:key/delete
+func handleAdminSessionDeletePost(c echo.Context) error {
+	if err := sessionManager.DeleteByKey("", c.Param("key")); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("Session[Key=%s] Deleted by Admin.", c.Param("key"))
+	return c.Redirect(http.StatusSeeOther, "/admin/sessions")
+}
+
+// ユーザーのセッション一覧画面に渡すデータ
+type adminUserSessionsPage struct {
+	UserID   string
+	Sessions []session.Info
+}
+
+// GET:/admin/users/:user_id/sessions
+func handleAdminUserSessionsGet(c echo.Context) error {
+	userID := c.Param("user_id")
+	sessions, err := sessionManager.ListByUser(userID)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	data := adminUserSessionsPage{UserID: userID, Sessions: sessions}
+	return c.Render(http.StatusOK, "admin_user_sessions", data)
+}
+
+// POST:/admin/users/:user_id/sessions/:key/delete
+func handleAdminUserSessionDeletePost(c echo.Context) error {
+	userID := c.Param("user_id")
+	if err := sessionManager.DeleteByKey(userID, c.Param("key")); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[%s] Session Deleted by Admin.", userID)
+	return c.Redirect(http.StatusSeeOther, "/admin/users/"+userID+"/sessions")
+}
+
+// POST:/admin/users/:user_id/sessions/delete
+func handleAdminUserSessionsDeletePost(c echo.Context) error {
+	userID := c.Param("user_id")
+	if err := sessionManager.DeleteByUser(userID); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[%s] All Sessions Deleted by Admin.", userID)
+	return c.Redirect(http.StatusSeeOther, "/admin/users/"+userID+"/sessions")
 }
 
 // GET:/login
@@ -71,13 +308,62 @@ func handleLoginGet(c echo.Context) error {
 func handleLoginPost(c echo.Context) error {
 	userID := c.FormValue("userid")
 	password := c.FormValue("password")
-	err := UserLogin(c, userID, password)
+	remember := c.FormValue("remember") == "1"
+	err := UserLogin(c, userID, password, remember)
+	if err == ErrorTOTPRequired {
+		// 二段階認証のコード入力画面に遷移する
+		return c.Redirect(http.StatusSeeOther, "/login/totp")
+	}
+	if err == ErrorPasswordChangeRequired {
+		// パスワードの変更画面に遷移する
+		return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/password")
+	}
 	if err != nil {
 		c.Echo().Logger.Debugf("User[%s] Login Error. [%s]", userID, err)
 		msg := "ユーザーIDまたはパスワードが誤っています。"
-		data := map[string]string{"user_id": userID, "password": "", "msg": msg}
-		return c.Render(http.StatusOK, "login", data)
+		if err == ErrorLoginLocked {
+			msg = "ログインの失敗が続いたため、一時的にロックされています。しばらくしてから再度お試しください。"
+		}
+		if err == ErrorSessionLimit {
+			msg = "同時にログインできる数の上限に達しています。他の端末でログアウトしてから再度お試しください。"
+		}
+		addFlash(c, session.FlashError, msg)
+		return c.Redirect(http.StatusSeeOther, "/login")
 	}
+	return redirectAfterLogin(c, userID)
+}
+
+// GET:/login/totp
+func handleLoginTOTPGet(c echo.Context) error {
+	return c.Render(http.StatusOK, "login_totp", nil)
+}
+
+// POST:/login/totp
+func handleLoginTOTPPost(c echo.Context) error {
+	userID, err := UserLoginTOTP(c, c.FormValue("code"))
+	if err == ErrorPasswordChangeRequired {
+		// パスワードの変更画面に遷移する
+		return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/password")
+	}
+	if err != nil {
+		c.Echo().Logger.Debugf("TOTP Login Error. [%s]", err)
+		if err != ErrorInvalidTOTPCode && err != ErrorLoginLocked {
+			// パスワード確認済みのセッションがない場合はログインからやり直す
+			addFlash(c, session.FlashWarn, "もう一度ユーザーIDとパスワードを入力してください。")
+			return c.Redirect(http.StatusSeeOther, "/login")
+		}
+		msg := "確認コードが誤っています。"
+		if err == ErrorLoginLocked {
+			msg = "ログインの失敗が続いたため、一時的にロックされています。しばらくしてから再度お試しください。"
+		}
+		addFlash(c, session.FlashError, msg)
+		return c.Redirect(http.StatusSeeOther, "/login/totp")
+	}
+	return redirectAfterLogin(c, userID)
+}
+
+// ログイン完了後の画面に遷移する
+func redirectAfterLogin(c echo.Context, userID string) error {
 	// ログインしたユーザーが管理者かチェックする
 	isAdmin, err := CheckRoleByUserID(userID, model.RoleAdmin)
 	if err != nil {
@@ -87,9 +373,157 @@ func handleLoginPost(c echo.Context) error {
 	if isAdmin {
 		// 管理者でログインした場合には管理者のホーム画面に遷移する
 		c.Echo().Logger.Debugf("User is Admin. [%s]", userID)
-		return c.Redirect(http.StatusTemporaryRedirect, "/admin")
+		return c.Redirect(http.StatusSeeOther, "/admin")
+	}
+	return c.Redirect(http.StatusSeeOther, "/users/"+userID)
+}
+
+// GET:/users/:user_id/totp
+func handleUserTOTPGet(c echo.Context) error {
+	return renderUserTOTP(c)
+}
+
+// POST:/users/:user_id/totp
+func handleUserTOTPPost(c echo.Context) error {
+	userID := c.Param("user_id")
+	codes, err := ConfirmTOTPEnrollment(c, userID, c.FormValue("code"))
+	if err == ErrorInvalidTOTPCode {
+		addFlash(c, session.FlashError, "確認コードが誤っています。")
+		return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/totp")
+	}
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] TOTP Enrollment Error. [%s]", userID, err)
+		return c.Render(http.StatusOK, "error", err)
 	}
-	return c.Redirect(http.StatusTemporaryRedirect, "/users/"+userID)
+	data := map[string]interface{}{
+		"user_id":        userID,
+		"enabled":        true,
+		"recovery_codes": codes,
+	}
+	return c.Render(http.StatusOK, "user_totp", data)
+}
+
+// POST:/users/:user_id/totp/disable
+func handleUserTOTPDisablePost(c echo.Context) error {
+	userID := c.Param("user_id")
+	err := DisableTOTP(c, userID, c.FormValue("password"))
+	if err == ErrorInvalidPassword || err == ErrorLoginLocked {
+		msg := "パスワードが誤っています。"
+		if err == ErrorLoginLocked {
+			msg = "失敗が続いたため、一時的にロックされています。しばらくしてから再度お試しください。"
+		}
+		addFlash(c, session.FlashError, msg)
+		return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/totp")
+	}
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] TOTP Disable Error. [%s]", userID, err)
+		return c.Render(http.StatusOK, "error", err)
+	}
+	addFlash(c, session.FlashInfo, "二段階認証を無効にしました。")
+	return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/totp")
+}
+
+// 二段階認証の設定画面を表示する
+func renderUserTOTP(c echo.Context) error {
+	userID := c.Param("user_id")
+	err := CheckUserID(c, userID)
+	if err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "ログインしていません。"
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	user := users[0]
+	data := map[string]interface{}{
+		"user_id": userID,
+		"enabled": user.TOTPEnabled(),
+	}
+	if !user.TOTPEnabled() {
+		// 登録用のシークレットとQRコードを表示する
+		secret, err := BeginTOTPEnrollment(c, userID)
+		if err != nil {
+			return c.Render(http.StatusOK, "error", err)
+		}
+		uri := TOTPProvisioningURI(userID, secret)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 200)
+		if err != nil {
+			return c.Render(http.StatusOK, "error", err)
+		}
+		data["secret"] = secret
+		data["uri"] = uri
+		data["qrcode"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	return c.Render(http.StatusOK, "user_totp", data)
+}
+
+// GET:/users/:user_id/password
+func handleUserPasswordGet(c echo.Context) error {
+	userID := c.Param("user_id")
+	err := CheckPasswordChangeUser(c, userID)
+	if err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "ログインしていません。"
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	return renderUserPassword(c, userID)
+}
+
+// POST:/users/:user_id/password
+func handleUserPasswordPost(c echo.Context) error {
+	userID := c.Param("user_id")
+	err := CheckPasswordChangeUser(c, userID)
+	if err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "ログインしていません。"
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	newPassword := c.FormValue("new_password")
+	if newPassword != c.FormValue("new_password_confirm") {
+		addFlash(c, session.FlashError, "新しいパスワードが確認用と一致しません。")
+		return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/password")
+	}
+	err = ChangePassword(c, userID, c.FormValue("current_password"), newPassword)
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] Password Change Error. [%s]", userID, err)
+		var msg string
+		switch err {
+		case ErrorInvalidPassword:
+			msg = "現在のパスワードが誤っています。"
+		case ErrorLoginLocked:
+			msg = "失敗が続いたため、一時的にロックされています。しばらくしてから再度お試しください。"
+		case ErrorPasswordUnchanged:
+			msg = "現在のパスワードとは異なるパスワードを入力してください。"
+		case model.ErrorPasswordTooShort:
+			msg = "パスワードは" + strconv.Itoa(setting.Password.MinLength) + "文字以上にしてください。"
+		case model.ErrorPasswordIsUserID:
+			msg = "ユーザーIDと同じパスワードは使用できません。"
+		case model.ErrorPasswordBanned:
+			msg = "推測されやすいパスワードのため使用できません。"
+		default:
+			return c.Render(http.StatusOK, "error", err)
+		}
+		addFlash(c, session.FlashError, msg)
+		return c.Redirect(http.StatusSeeOther, "/users/"+userID+"/password")
+	}
+	addFlash(c, session.FlashInfo, "パスワードを変更しました。")
+	return redirectAfterLogin(c, userID)
+}
+
+// パスワードの変更画面を表示する
+func renderUserPassword(c echo.Context, userID string) error {
+	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	data := map[string]interface{}{
+		"user_id":    userID,
+		"must":       users[0].MustChangePassword,
+		"min_length": setting.Password.MinLength,
+	}
+	return c.Render(http.StatusOK, "user_password", data)
 }
 
 // POST:/logout
@@ -97,9 +531,15 @@ func handleLogoutPost(c echo.Context) error {
 	err := UserLogout(c)
 	if err != nil {
 		c.Echo().Logger.Debugf("User Logout Error. [%s]", err)
-		return c.Render(http.StatusOK, "login", nil)
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	addFlash(c, session.FlashInfo, "ログアウトしました。")
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// フラッシュメッセージを追加する（リダイレクト先の画面で表示される）
+func addFlash(c echo.Context, level string, message string) {
+	if err := session.FromContext(c).AddFlash(level, message); err != nil {
+		c.Echo().Logger.Debugf("Flash Message Error. [%s]", err)
 	}
-	msg := "ログアウトしました。"
-	data := map[string]string{"user_id": "", "password": "", "msg": msg}
-	return c.Render(http.StatusOK, "login", data)
 }
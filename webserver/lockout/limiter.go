@@ -0,0 +1,150 @@
+package lockout
+
+import (
+	"errors"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Config は Limiterの動作に関する設定です。
+type Config struct {
+	MaxFailures   int           // ロックするまでに許容する連続失敗回数
+	BaseDuration  time.Duration // 最初のロック時間（以降、失敗する度に倍になる）
+	MaxDuration   time.Duration // ロック時間の上限
+	FailureWindow time.Duration // 最後の失敗からこの時間が経過したら失敗回数をリセットする
+}
+
+// Entry はキー毎の失敗回数とロック状態です。
+type Entry struct {
+	Key         string
+	Failures    int
+	LockedUntil time.Time
+}
+
+// Limiter はキー（ユーザーIDやIPアドレス）毎にログインの失敗回数を数え、
+// 失敗が続いた場合に一時的にロックします。
+type Limiter struct {
+	config    Config
+	stopCh    chan struct{}
+	commandCh chan command
+}
+
+// Start は Limiterの開始を行います。
+func (l *Limiter) Start(echo *echo.Echo, config Config) {
+	setEcho(echo)
+	l.config = config
+	// メインループの開始前にチャネルを作成し、直後の呼び出しでも待たされないようにする
+	l.stopCh = make(chan struct{}, 1)
+	l.commandCh = make(chan command, 1)
+	go l.mainLoop()
+}
+
+// Stop は Limiterの停止を行います。
+func (l *Limiter) Stop() {
+	l.stopCh <- struct{}{}
+}
+
+// Check は キーがロックされていないか確認し、1回分の試行を予約します。
+// ロックされている場合は残り時間と ErrorLocked を返します。
+// 同時に行われている試行も数えるため、失敗回数と予約中の試行の合計が
+// 上限に達している場合も、残り時間0と ErrorLocked を返します。
+// ロックの期限が切れた後は1回ずつ試行を予約でき、続けて失敗すると
+// 前回より長い時間（MaxDuration まで倍に）ロックします。
+// 予約した試行は、結果に関わらず終了時に Release で解放してください。
+func (l *Limiter) Check(key string) (time.Duration, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{key}
+	cmd := command{commandCheck, req, respCh}
+	l.commandCh <- cmd
+	resp := <-respCh
+	var res time.Duration
+	if resp.err != nil {
+		if resp.err == ErrorLocked {
+			res, _ = resp.result[0].(time.Duration)
+		}
+		e.Logger.Debugf("Lockout[%s] Check Error. [%s]", key, resp.err)
+		return res, resp.err
+	}
+	return res, nil
+}
+
+// Fail は キーの失敗回数を加算します。
+// ロックされた場合はロック時間を返します。
+func (l *Limiter) Fail(key string) (time.Duration, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{key}
+	cmd := command{commandFail, req, respCh}
+	l.commandCh <- cmd
+	resp := <-respCh
+	var res time.Duration
+	if resp.err != nil {
+		e.Logger.Debugf("Lockout[%s] Fail Error. [%s]", key, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(time.Duration); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("Lockout[%s] Fail Error. [%s]", key, ErrorOther)
+	return res, ErrorOther
+}
+
+// Release は Check で予約した試行を解放します。
+// 失敗した場合は、先に Fail で失敗回数を加算してから呼び出します。
+func (l *Limiter) Release(key string) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{key}
+	cmd := command{commandRelease, req, respCh}
+	l.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("Lockout[%s] Release Error. [%s]", key, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// Reset は キーの失敗回数とロックを解除します。
+func (l *Limiter) Reset(key string) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{key}
+	cmd := command{commandReset, req, respCh}
+	l.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("Lockout[%s] Reset Error. [%s]", key, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// ListLocked は 現在ロックされているキーの一覧を返します。
+func (l *Limiter) ListLocked() ([]Entry, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	cmd := command{commandListLocked, nil, respCh}
+	l.commandCh <- cmd
+	resp := <-respCh
+	var res []Entry
+	if resp.err != nil {
+		e.Logger.Debugf("Lockout ListLocked Error. [%s]", resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].([]Entry); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("Lockout ListLocked Error. [%s]", ErrorOther)
+	return res, ErrorOther
+}
+
+// Limiterが返す各エラーのインスタンスを生成します。
+var (
+	ErrorLocked         = errors.New("Locked")
+	ErrorBadParameter   = errors.New("Bad Parameter")
+	ErrorInvalidCommand = errors.New("Invalid Command")
+	ErrorOther          = errors.New("Other")
+)
@@ -0,0 +1,219 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// echoのインスタンス
+var (
+	e     *echo.Echo
+	eOnce sync.Once
+)
+
+// ログの出力に使用するechoのインスタンスを設定する
+// （ユーザーID用・IPアドレス用の Limiter が競合しないよう、最初に開始した際の1回のみ設定する）
+func setEcho(echo *echo.Echo) {
+	eOnce.Do(func() {
+		e = echo
+	})
+}
+
+// コマンド種別の定義
+type commandType int
+
+const (
+	commandCheck      commandType = iota // ロック状態の確認と試行の予約
+	commandFail                          // 失敗回数の加算
+	commandRelease                       // 試行の予約の解放
+	commandReset                         // 失敗回数とロックの解除
+	commandListLocked                    // ロック中のキーの一覧
+)
+
+// コマンド実行のためのパラメータ
+type command struct {
+	cmdType    commandType
+	req        []interface{}
+	responseCh chan response
+}
+
+// コマンド実行の結果
+type response struct {
+	result []interface{}
+	err    error
+}
+
+// 予約した試行が解放されなかった場合に、予約を取り消すまでの時間
+const reservationTimeout = 1 * time.Minute
+
+// キー毎の状態
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	pending     int       // 予約中の試行の数
+	lastReserve time.Time // 最後に試行を予約した日時
+}
+
+// 予約中の試行の数（解放されずに残った古い予約は数えない）
+func (x *entry) pendingAt(now time.Time) int {
+	if now.Sub(x.lastReserve) > reservationTimeout {
+		return 0
+	}
+	return x.pending
+}
+
+// 失敗回数をリセットするまでの時間が経過したか
+// （ロックされた場合は、ロックの終了から数えて次の失敗でより長くロックできるようにする）
+func (x *entry) expired(now time.Time, window time.Duration) bool {
+	last := x.lastFailure
+	if x.lockedUntil.After(last) {
+		last = x.lockedUntil
+	}
+	return now.Sub(last) > window
+}
+
+// Limiter のメインループ処理
+func (l *Limiter) mainLoop() {
+	entries := make(map[string]entry)
+	defer close(l.commandCh)
+	defer close(l.stopCh)
+	// 不要になったエントリを定期的に削除する
+	t := time.NewTicker(1 * time.Minute)
+	defer t.Stop()
+	e.Logger.Info("lockout.Limiter:start")
+loop:
+	for {
+		// 受信したコマンドによって処理を振り分ける
+		select {
+		case cmd := <-l.commandCh:
+			switch cmd.cmdType {
+			// ロック状態の確認と試行の予約
+			case commandCheck:
+				reqKey, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				now := time.Now()
+				x := entries[reqKey]
+				if now.Before(x.lockedUntil) {
+					res := []interface{}{x.lockedUntil.Sub(now)}
+					cmd.responseCh <- response{res, ErrorLocked}
+					break
+				}
+				failures := x.failures
+				if x.expired(now, l.config.FailureWindow) {
+					failures = 0
+				}
+				// 同時に行われている試行が全て失敗した場合に上限を超えないよう、予約中の試行を数える
+				// （ロックの期限が切れた後は1回ずつ試行させ、次の失敗でより長くロックする）
+				limit := l.config.MaxFailures - failures
+				if limit < 1 {
+					limit = 1
+				}
+				if x.pendingAt(now) >= limit {
+					res := []interface{}{time.Duration(0)}
+					cmd.responseCh <- response{res, ErrorLocked}
+					break
+				}
+				x.pending = x.pendingAt(now) + 1
+				x.lastReserve = now
+				entries[reqKey] = x
+				cmd.responseCh <- response{nil, nil}
+			// 失敗回数の加算
+			case commandFail:
+				reqKey, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				now := time.Now()
+				x := entries[reqKey]
+				if x.expired(now, l.config.FailureWindow) {
+					x = entry{pending: x.pending, lastReserve: x.lastReserve}
+				}
+				x.failures++
+				x.lastFailure = now
+				var lockDuration time.Duration
+				if x.failures >= l.config.MaxFailures {
+					lockDuration = l.lockDuration(x.failures - l.config.MaxFailures)
+					x.lockedUntil = now.Add(lockDuration)
+					e.Logger.Infof("Lockout[%s] Locked. failures[%d] until[%s]", reqKey, x.failures, x.lockedUntil)
+				}
+				entries[reqKey] = x
+				res := []interface{}{lockDuration}
+				cmd.responseCh <- response{res, nil}
+			// 試行の予約の解放
+			case commandRelease:
+				reqKey, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				// Reset 済みの場合など、エントリが無い場合は何もしない
+				if x, ok := entries[reqKey]; ok {
+					x.pending = x.pendingAt(time.Now()) - 1
+					if x.pending < 0 {
+						x.pending = 0
+					}
+					entries[reqKey] = x
+				}
+				cmd.responseCh <- response{nil, nil}
+			// 失敗回数とロックの解除
+			case commandReset:
+				reqKey, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				if _, ok := entries[reqKey]; ok {
+					delete(entries, reqKey)
+					e.Logger.Debugf("Lockout[%s] Reset.", reqKey)
+				}
+				cmd.responseCh <- response{nil, nil}
+			// ロック中のキーの一覧
+			case commandListLocked:
+				now := time.Now()
+				results := []Entry{}
+				for k, x := range entries {
+					if now.Before(x.lockedUntil) {
+						results = append(results, Entry{k, x.failures, x.lockedUntil})
+					}
+				}
+				res := []interface{}{results}
+				cmd.responseCh <- response{res, nil}
+			// それ以外（エラー）
+			default:
+				cmd.responseCh <- response{nil, ErrorInvalidCommand}
+			}
+		case <-t.C:
+			now := time.Now()
+			for k, x := range entries {
+				if x.expired(now, l.config.FailureWindow) && x.pendingAt(now) == 0 {
+					delete(entries, k)
+				}
+			}
+		case <-l.stopCh:
+			break loop
+		}
+	}
+	e.Logger.Info("lockout.Limiter:stop")
+}
+
+// ロック時間の計算（回数を超える度に倍にし、上限で打ち止めにする）
+func (l *Limiter) lockDuration(over int) time.Duration {
+	d := l.config.BaseDuration
+	for i := 0; i < over; i++ {
+		d *= 2
+		if d >= l.config.MaxDuration {
+			return l.config.MaxDuration
+		}
+	}
+	if d > l.config.MaxDuration {
+		return l.config.MaxDuration
+	}
+	return d
+}
@@ -0,0 +1,78 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ロックの期限が切れた後は1回ずつ試行でき、再び失敗すると前回より長くロックされることを確認する
+func TestLimiterRelockAfterExpiry(t *testing.T) {
+	l := &Limiter{}
+	l.Start(echo.New(), Config{
+		MaxFailures:   2,
+		BaseDuration:  100 * time.Millisecond,
+		MaxDuration:   time.Second,
+		FailureWindow: time.Minute,
+	})
+	defer l.Stop()
+
+	// 予約した試行を失敗させる
+	fail := func() time.Duration {
+		if _, err := l.Check("alice"); err != nil {
+			t.Fatalf("Check() = %v, want nil", err)
+		}
+		d, err := l.Fail("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Release("alice"); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	// ロックされていることを確認する
+	checkLocked := func() {
+		if _, err := l.Check("alice"); err != ErrorLocked {
+			t.Fatalf("Check() = %v, want ErrorLocked", err)
+		}
+		locked, err := l.ListLocked()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locked) != 1 || locked[0].Key != "alice" {
+			t.Fatalf("ListLocked() = %v, want [alice]", locked)
+		}
+	}
+
+	fail()
+	first := fail()
+	if first != 100*time.Millisecond {
+		t.Fatalf("first lock = %s, want 100ms", first)
+	}
+	checkLocked()
+
+	time.Sleep(first + 50*time.Millisecond)
+	if locked, _ := l.ListLocked(); len(locked) != 0 {
+		t.Fatalf("ListLocked() = %v, want none after expiry", locked)
+	}
+	// 期限が切れた後も、同時に予約できる試行は1回だけ
+	if _, err := l.Check("alice"); err != nil {
+		t.Fatalf("Check() after expiry = %v, want nil", err)
+	}
+	if _, err := l.Check("alice"); err != ErrorLocked {
+		t.Fatalf("second Check() after expiry = %v, want ErrorLocked", err)
+	}
+	second, err := l.Fail("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if second != 2*first {
+		t.Fatalf("second lock = %s, want %s", second, 2*first)
+	}
+	checkLocked()
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PasswordHash はハッシュ化されたパスワードです。
+// "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>" のように、
+// 使用したアルゴリズムとパラメータを含んだ文字列で保存します。
+// 旧形式のMD5ハッシュ（StringMD5）も検証できます。
+type PasswordHash string
+
+// argon2idのパラメータ
+const (
+	argon2Memory  uint32 = 19 * 1024 // KiB
+	argon2Time    uint32 = 2
+	argon2Threads uint8  = 1
+	argon2SaltLen        = 16
+	argon2KeyLen  uint32 = 32
+)
+
+// 保存されたハッシュで許容するargon2idのパラメータの上限
+// （改ざんされたハッシュで大量のメモリや時間を使わせないようにする）
+const (
+	argon2MaxMemory uint32 = 1024 * 1024 // KiB
+	argon2MaxTime   uint32 = 16
+	argon2MaxKeyLen        = 128
+)
+
+// パスワードハッシュに関するエラー
+var (
+	ErrorInvalidHash = errors.New("Invalid Hash")
+)
+
+// HashPassword は、パスワードをargon2idでハッシュ化した文字列を返します。
+func HashPassword(password string) (PasswordHash, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	encoder := base64.RawStdEncoding
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		encoder.EncodeToString(salt), encoder.EncodeToString(key))
+	return PasswordHash(hash), nil
+}
+
+// Verify は、パスワードがハッシュと一致するか確認します。
+// 比較は一定時間で行います。
+func (h PasswordHash) Verify(password string) bool {
+	if h.isLegacyMD5() {
+		// MD5はargon2idに比べて極端に速く、所要時間から旧形式のアカウントが
+		// 判別できてしまうため、ダミーのハッシュでも検証して時間を揃える
+		VerifyDummyPassword(password)
+		expected := []byte(h)
+		actual := []byte(EncodeStringMD5(password))
+		return subtle.ConstantTimeCompare(actual, expected) == 1
+	}
+	params, salt, key, err := h.decodeArgon2()
+	if err != nil {
+		return false
+	}
+	actual := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1
+}
+
+// ダミーのパスワードハッシュ（UserDataAccessor の開始時に作成する）
+var dummyHash PasswordHash
+
+// ダミーのハッシュを作成する。
+// 最初の存在しないユーザーでのログインだけが遅くならないよう、事前に作成しておく
+func prepareDummyPassword() error {
+	hash, err := HashPassword("dummy password")
+	if err != nil {
+		return err
+	}
+	dummyHash = hash
+	return nil
+}
+
+// VerifyDummyPassword は、ダミーのハッシュに対してパスワードを検証します。
+// ユーザーが存在しない場合にも Verify と同じだけ時間をかけることで、
+// 応答時間からユーザーの有無を推測されないようにするために使用します。
+func VerifyDummyPassword(password string) {
+	dummyHash.Verify(password)
+}
+
+// NeedsRehash は、ハッシュを現在のアルゴリズム・パラメータで
+// 作り直す必要があるか確認します。
+func (h PasswordHash) NeedsRehash() bool {
+	if h.isLegacyMD5() {
+		return true
+	}
+	params, _, key, err := h.decodeArgon2()
+	if err != nil {
+		return true
+	}
+	return params.memory != argon2Memory || params.time != argon2Time ||
+		params.threads != argon2Threads || uint32(len(key)) != argon2KeyLen
+}
+
+// 旧形式のMD5ハッシュ（32桁の16進数）か確認する
+func (h PasswordHash) isLegacyMD5() bool {
+	return len(h) == 32 && !strings.HasPrefix(string(h), "$")
+}
+
+// argon2idのパラメータ
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// argon2id形式のハッシュをパラメータ・ソルト・ハッシュ値に分解する
+func (h PasswordHash) decodeArgon2() (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(string(h), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrorInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrorInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, ErrorInvalidHash
+	}
+	// t・pが0の場合はargon2がpanicするため、範囲外のパラメータはエラーにする
+	if params.time < 1 || params.time > argon2MaxTime || params.threads < 1 ||
+		params.memory < 8*uint32(params.threads) || params.memory > argon2MaxMemory {
+		return params, nil, nil, ErrorInvalidHash
+	}
+	encoder := base64.RawStdEncoding
+	salt, err := encoder.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrorInvalidHash
+	}
+	key, err := encoder.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || len(key) > argon2MaxKeyLen {
+		return params, nil, nil, ErrorInvalidHash
+	}
+	return params, salt, key, nil
+}
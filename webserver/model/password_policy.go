@@ -0,0 +1,61 @@
+package model
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"../setting"
+)
+
+// パスワードポリシーに関するエラー
+var (
+	ErrorPasswordTooShort = errors.New("Password Too Short")
+	ErrorPasswordBanned   = errors.New("Password Banned")
+	ErrorPasswordIsUserID = errors.New("Password Is UserID")
+)
+
+// 使用を禁止するパスワードの一覧（小文字で保持する）
+var bannedPasswords = map[string]struct{}{}
+
+// LoadPasswordPolicy は、設定に従って使用を禁止するパスワードの一覧を読み込みます。
+// ファイルは1行に1つのパスワードを記述し、空行と # で始まる行は無視します。
+func LoadPasswordPolicy() error {
+	banned := map[string]struct{}{}
+	if setting.Password.BannedListFile != "" {
+		f, err := os.Open(setting.Password.BannedListFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			banned[strings.ToLower(line)] = struct{}{}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	bannedPasswords = banned
+	return nil
+}
+
+// CheckPasswordPolicy は、新しいパスワードがポリシーを満たしているか確認します。
+func CheckPasswordPolicy(userID string, password string) error {
+	if utf8.RuneCountInString(password) < setting.Password.MinLength {
+		return ErrorPasswordTooShort
+	}
+	if strings.EqualFold(password, userID) {
+		return ErrorPasswordIsUserID
+	}
+	if _, ok := bannedPasswords[strings.ToLower(password)]; ok {
+		return ErrorPasswordBanned
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// RememberToken はログインしたままにするためのトークンの情報です。
+// トークンは系列（Family）と検証値（Validator）からなり、使用する度に
+// 同じ系列の新しい検証値に置き換えます。置き換え済みの検証値が使われた場合は、
+// トークンが盗まれたものとみなして系列ごと無効にします。
+// 検証値はハッシュ化して保存します。
+type RememberToken struct {
+	Family            string    `json:"family"`
+	Validator         string    `json:"validator"`
+	PreviousValidator string    `json:"previous_validator,omitempty"`
+	Rotated           time.Time `json:"rotated"`
+	Expire            time.Time `json:"expire"`
+}
+
+// トークンのパラメータ
+const (
+	rememberTokenLen = 32 // バイト
+	// 置き換え直後に同時に送られてきた古い検証値を、盗用とみなさない時間
+	rememberRotateGrace = 1 * time.Minute
+)
+
+// RememberToken の操作が返すエラーのインスタンスを生成します。
+var (
+	ErrorRememberTokenReused  = errors.New("Remember Token Reused")
+	ErrorRememberTokenRotated = errors.New("Remember Token Rotated")
+)
+
+// ログインしたままにするトークンを新しい系列で発行する（期限切れのトークンは削除する）
+func (u *User) issueRememberToken(now time.Time, expire time.Time) (string, string, error) {
+	family, err := newRememberSecret()
+	if err != nil {
+		return "", "", err
+	}
+	validator, err := newRememberSecret()
+	if err != nil {
+		return "", "", err
+	}
+	tokens := []RememberToken{}
+	for _, x := range u.RememberTokens {
+		if now.Before(x.Expire) {
+			tokens = append(tokens, x)
+		}
+	}
+	token := RememberToken{
+		Family:    family,
+		Validator: hashRememberValidator(validator),
+		Rotated:   now,
+		Expire:    expire,
+	}
+	u.RememberTokens = append(tokens, token)
+	return family, validator, nil
+}
+
+// トークンを確認し、同じ系列の新しい検証値に置き換える
+// 置き換え済みの検証値の場合は系列を削除して ErrorRememberTokenReused を返す
+func (u *User) rotateRememberToken(family string, validator string, now time.Time, expire time.Time) (string, error) {
+	for i, x := range u.RememberTokens {
+		if x.Family != family {
+			continue
+		}
+		if !now.Before(x.Expire) {
+			return "", ErrorNotFound
+		}
+		hash := hashRememberValidator(validator)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(x.Validator)) != 1 {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(x.PreviousValidator)) == 1 && now.Before(x.Rotated.Add(rememberRotateGrace)) {
+				return "", ErrorRememberTokenRotated
+			}
+			u.revokeRememberToken(family)
+			return "", ErrorRememberTokenReused
+		}
+		newValidator, err := newRememberSecret()
+		if err != nil {
+			return "", err
+		}
+		u.RememberTokens[i].PreviousValidator = x.Validator
+		u.RememberTokens[i].Validator = hashRememberValidator(newValidator)
+		u.RememberTokens[i].Rotated = now
+		u.RememberTokens[i].Expire = expire
+		return newValidator, nil
+	}
+	return "", ErrorNotFound
+}
+
+// 系列のトークンを削除する（familyが空の場合は全て削除する）
+func (u *User) revokeRememberToken(family string) {
+	tokens := []RememberToken{}
+	if family != "" {
+		for _, x := range u.RememberTokens {
+			if x.Family != family {
+				tokens = append(tokens, x)
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		tokens = nil
+	}
+	u.RememberTokens = tokens
+}
+
+// トークンに使用するランダムな文字列を生成する
+func newRememberSecret() (string, error) {
+	b := make([]byte, rememberTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 検証値のハッシュ（十分に長いランダムな値のため、ストレッチングは行わない）
+func hashRememberValidator(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
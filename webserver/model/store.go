@@ -0,0 +1,44 @@
+package model
+
+import (
+	"../setting"
+)
+
+// UserStore はユーザー情報を永続化するストレージのインターフェースです。
+// UserDataAccessor は起動時に LoadAll で全件を読み込んでメモリ上に保持し、
+// 更新がある度に Put / Delete でストレージへ反映します。
+type UserStore interface {
+	// Open はストレージを開きます。
+	Open() error
+	// Close はストレージを閉じます。
+	Close() error
+	// LoadAll は保存されているユーザーを全件読み込みます。
+	LoadAll() ([]User, error)
+	// Put はユーザーを保存します。同じIDのユーザーが存在する場合は上書きします。
+	Put(user User) error
+	// Delete はIDが一致するユーザーを削除します。
+	Delete(id ID) error
+}
+
+// ストレージの種別
+const (
+	UserStoreJSON = "json" // JSONファイル
+	UserStoreBolt = "bolt" // bbolt（組み込みKey/Valueストア）
+)
+
+// 設定に応じたストレージを生成する
+func newUserStore() (UserStore, error) {
+	switch setting.UserData.Backend {
+	case UserStoreJSON:
+		return &jsonUserStore{
+			path:        setting.UserData.FilePath,
+			backupCount: setting.UserData.BackupCount,
+		}, nil
+	case UserStoreBolt:
+		return &boltUserStore{
+			path:     setting.UserData.BoltPath,
+			seedPath: setting.UserData.FilePath,
+		}, nil
+	}
+	return nil, ErrorBadParameter
+}
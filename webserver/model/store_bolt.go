@@ -0,0 +1,120 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ユーザー情報を保存するバケット名
+var boltUsersBucket = []byte("users")
+
+// bbolt（組み込みKey/Valueストア）を使用するストレージ
+type boltUserStore struct {
+	path     string
+	seedPath string
+	db       *bolt.DB
+}
+
+func (s *boltUserStore) Open() error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	s.db = db
+	empty := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltUsersBucket)
+		if err != nil {
+			return err
+		}
+		k, _ := b.Cursor().First()
+		empty = k == nil
+		return nil
+	})
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	// 初回起動時はJSONファイルの内容を取り込む
+	if empty {
+		if err := s.seed(); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltUserStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltUserStore) LoadAll() ([]User, error) {
+	results := []User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			user := User{}
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			results = append(results, user)
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (s *boltUserStore) Put(user User) error {
+	bytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Put([]byte(user.ID), bytes)
+	})
+}
+
+func (s *boltUserStore) Delete(id ID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsersBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrorNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// JSONファイルのユーザー情報を取り込む
+func (s *boltUserStore) seed() error {
+	if s.seedPath == "" {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(s.seedPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []User
+	if err := json.Unmarshal(bytes, &records); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsersBucket)
+		for _, x := range records {
+			v, err := json.Marshal(x)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(x.ID), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// JSONファイルを使用するストレージ
+type jsonUserStore struct {
+	path        string
+	backupCount int
+	records     map[ID]User
+}
+
+func (s *jsonUserStore) Open() error {
+	s.records = make(map[ID]User)
+	// JSONファイル読み込み
+	bytes, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	// JSONをデコードする
+	var records []User
+	if err := json.Unmarshal(bytes, &records); err != nil {
+		return err
+	}
+	// 結果をmapにセットする
+	for _, x := range records {
+		s.records[x.ID] = x
+	}
+	return nil
+}
+
+func (s *jsonUserStore) Close() error {
+	return nil
+}
+
+func (s *jsonUserStore) LoadAll() ([]User, error) {
+	results := []User{}
+	for _, x := range s.records {
+		user := User{}
+		user.Copy(&x)
+		results = append(results, user)
+	}
+	return results, nil
+}
+
+func (s *jsonUserStore) Put(user User) error {
+	oldUser, exists := s.records[user.ID]
+	record := User{}
+	record.Copy(&user)
+	s.records[user.ID] = record
+	if err := s.encodeJSON(); err != nil {
+		if exists {
+			s.records[user.ID] = oldUser
+		} else {
+			delete(s.records, user.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *jsonUserStore) Delete(id ID) error {
+	oldUser, exists := s.records[id]
+	if !exists {
+		return ErrorNotFound
+	}
+	delete(s.records, id)
+	if err := s.encodeJSON(); err != nil {
+		s.records[id] = oldUser
+		return err
+	}
+	return nil
+}
+
+func (s *jsonUserStore) encodeJSON() error {
+	// 差分が見やすいようにUserID順に並べる
+	records := []User{}
+	for _, x := range s.records {
+		records = append(records, x)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].UserID < records[j].UserID
+	})
+	bytes, err := json.MarshalIndent(records, "", "    ")
+	if err != nil {
+		return err
+	}
+	// 一時ファイルに書き込んでからリネームすることで、
+	// 書き込み途中でクラッシュしてもファイルが壊れないようにする
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// 一時ファイルは0600で作成されるため、既存のファイルの権限を引き継ぐ
+	if info, err := os.Stat(s.path); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := rotateBackups(s.path, s.backupCount); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// バックアップファイル（path.1 〜 path.N）を1世代ずつずらし、
+// 現在のファイルをpath.1として残す
+func rotateBackups(path string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backupName := func(n int) string {
+		return fmt.Sprintf("%s.%d", path, n)
+	}
+	os.Remove(backupName(count))
+	for n := count - 1; n >= 1; n-- {
+		if _, err := os.Stat(backupName(n)); err == nil {
+			if err := os.Rename(backupName(n), backupName(n+1)); err != nil {
+				return err
+			}
+		}
+	}
+	// 元のファイルはリネーム直前まで残しておきたいので、コピーでバックアップを作る
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// バックアップにも元のファイルと同じ権限を設定する（umaskの影響を受けないようChmodする）
+	if err := ioutil.WriteFile(backupName(1), bytes, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chmod(backupName(1), info.Mode().Perm())
+}
@@ -0,0 +1,153 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP（RFC 6238）のパラメータ
+const (
+	totpPeriod    = 30 // 秒
+	totpDigits    = 6
+	totpSkew      = 1 // 前後に許容するステップ数
+	totpSecretLen = 20
+)
+
+// リカバリーコードの発行数
+const recoveryCodeCount = 10
+
+// 二段階認証のコードの使用時のエラーの定義
+var (
+	ErrorTOTPCodeUsed        = errors.New("TOTP Code Already Used")
+	ErrorRecoveryCodeInvalid = errors.New("Invalid Recovery Code")
+)
+
+// シークレットのエンコード方式（Base32・パディングなし）
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret は、TOTPのシークレットを新しく生成します。
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI は、認証アプリに登録するための otpauth:// 形式のURIを返します。
+func TOTPProvisioningURI(issuer string, accountName string, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(accountName)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// VerifyTOTP は、コードが指定時刻のTOTPと一致するか確認します。
+// 時計のずれを考慮して前後1ステップまで許容し、一致したステップを返します。
+// 同じコードの再利用を防ぐため、lastStep 以前のステップは一致とみなしません。
+func VerifyTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected := totpCode(key, step)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ステップに対応するコードを計算する（RFC 4226 HOTP）
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// GenerateRecoveryCodes は、リカバリーコードを生成します。
+// 利用者に表示するためのコードと、保存するためのハッシュを返します。
+func GenerateRecoveryCodes() ([]string, []PasswordHash, error) {
+	codes := []string{}
+	hashes := []PasswordHash{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := s[:4] + "-" + s[4:]
+		hash, err := HashPassword(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// code がリカバリーコードの形式（xxxx-xxxx）か確認する
+func isRecoveryCodeFormat(code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) != 9 || code[4] != '-' {
+		return false
+	}
+	for i, r := range code {
+		if i == 4 {
+			continue
+		}
+		// Base32（小文字）の文字のみ
+		if !(r >= 'a' && r <= 'z') && !(r >= '2' && r <= '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// TOTPEnabled は、ユーザーが二段階認証を有効にしているか確認します。
+func (u *User) TOTPEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// 一致するリカバリーコードのハッシュを返す
+func (u *User) matchRecoveryCode(code string) (PasswordHash, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	// ハッシュの確認は重いため、リカバリーコードの形式の場合のみ行う
+	if !isRecoveryCodeFormat(code) {
+		return "", false
+	}
+	for _, hash := range u.RecoveryCodes {
+		if hash.Verify(code) {
+			return hash, true
+		}
+	}
+	return "", false
+}
@@ -3,21 +3,31 @@ package model
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"io"
-	"io/ioutil"
+	"time"
 
 	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
 )
 
 // User はユーザーの情報を表します。
 type User struct {
-	ID       ID        `json:"id"`
-	UserID   string    `json:"user_id"`
-	Password StringMD5 `json:"password"`
-	FullName string    `json:"full_name"`
-	Roles    []Role    `json:"roles"`
+	ID            ID             `json:"id"`
+	UserID        string         `json:"user_id"`
+	Password      PasswordHash   `json:"password"`
+	FullName      string         `json:"full_name"`
+	Roles         []Role         `json:"roles"`
+	TOTPSecret    string         `json:"totp_secret,omitempty"`
+	TOTPLastStep  int64          `json:"totp_last_step,omitempty"`
+	RecoveryCodes []PasswordHash `json:"recovery_codes,omitempty"`
+	// 次回ログイン時にパスワードの変更を求める
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+	// ログインしたままにするためのトークン
+	RememberTokens []RememberToken `json:"remember_tokens,omitempty"`
+	// Cookieに保存するセッションの世代と、世代を進めた際に引き継いだセッション
+	SessionGeneration int64  `json:"session_generation,omitempty"`
+	SessionKeep       string `json:"session_keep,omitempty"`
 }
 
 // Copy は情報のコピーを行います。
@@ -28,18 +38,48 @@ func (u *User) Copy(f *User) {
 	u.FullName = f.FullName
 	u.Roles = make([]Role, len(f.Roles))
 	copy(u.Roles, f.Roles)
+	u.TOTPSecret = f.TOTPSecret
+	u.TOTPLastStep = f.TOTPLastStep
+	u.RecoveryCodes = nil
+	if f.RecoveryCodes != nil {
+		u.RecoveryCodes = make([]PasswordHash, len(f.RecoveryCodes))
+		copy(u.RecoveryCodes, f.RecoveryCodes)
+	}
+	u.MustChangePassword = f.MustChangePassword
+	u.RememberTokens = nil
+	if f.RememberTokens != nil {
+		u.RememberTokens = make([]RememberToken, len(f.RememberTokens))
+		copy(u.RememberTokens, f.RememberTokens)
+	}
+	u.SessionGeneration = f.SessionGeneration
+	u.SessionKeep = f.SessionKeep
 }
 
 // UserDataAccessor はユーザーの情報を操作するAPIを提供します。
 type UserDataAccessor struct {
 	stopCh    chan struct{}
 	commandCh chan command
+	store     UserStore
+	users     map[ID]User
+	// UserIDからIDを引くためのインデックス
+	userIDIndex map[string]ID
+}
+
+// HasRole はユーザーが指定された権限を持っているか確認します。
+func (u *User) HasRole(role Role) bool {
+	for _, v := range u.Roles {
+		if v == role {
+			return true
+		}
+	}
+	return false
 }
 
 // ID は情報を一意に識別するためのIDです。
 type ID string
 
 // StringMD5 はMD5ハッシュ化された文字列です。
+// パスワードには使用せず、PasswordHash を使用してください。
 type StringMD5 string
 
 // Role はユーザーの権限を表します。
@@ -54,10 +94,37 @@ const (
 // Start はAccessorの開始を行います。
 func (a *UserDataAccessor) Start(echo *echo.Echo) error {
 	e = echo
-	users = make(map[ID]User)
-	if err := a.decodeJSON(); err != nil {
+	if err := prepareDummyPassword(); err != nil {
+		return err
+	}
+	store, err := newUserStore()
+	if err != nil {
+		return err
+	}
+	if err := store.Open(); err != nil {
+		return err
+	}
+	records, err := store.LoadAll()
+	if err != nil {
+		store.Close()
 		return err
 	}
+	// 結果をmapにセットし、UserIDのインデックスを作成する
+	a.store = store
+	a.users = make(map[ID]User)
+	a.userIDIndex = make(map[string]ID)
+	for _, x := range records {
+		if _, ok := a.userIDIndex[x.UserID]; ok {
+			e.Logger.Errorf("User[UserID=%s] Duplicated in store.", x.UserID)
+			store.Close()
+			return ErrorDuplicateUserID
+		}
+		a.users[x.ID] = x
+		a.userIDIndex[x.UserID] = x.ID
+	}
+	// メインループの開始前にチャネルを作成し、直後の呼び出しでも待たされないようにする
+	a.stopCh = make(chan struct{}, 1)
+	a.commandCh = make(chan command, 1)
 	go a.mainLoop()
 	return nil
 }
@@ -87,6 +154,46 @@ func (a *UserDataAccessor) FindAll() ([]User, error) {
 	return res, ErrorOther
 }
 
+// Find は条件に一致するユーザーを検索します。
+func (a *UserDataAccessor) Find(query UserQuery) (UserQueryResult, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{query}
+	cmd := command{commandFind, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	var res UserQueryResult
+	if resp.err != nil {
+		e.Logger.Debugf("User Find Error. query[%v] [%s]", query, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(UserQueryResult); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User Find Error. query[%v] [%s]", query, ErrorOther)
+	return res, ErrorOther
+}
+
+// FindByID はIDでユーザーを検索します。
+func (a *UserDataAccessor) FindByID(reqID ID) (User, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqID}
+	cmd := command{commandFindByID, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Find Error. [%s]", reqID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[ID=%s] Find Error. [%s]", reqID, ErrorOther)
+	return res, ErrorOther
+}
+
 // FindByUserID はUserIDでユーザーを検索します。
 func (a *UserDataAccessor) FindByUserID(reqUserID string, option FindOption) ([]User, error) {
 	respCh := make(chan response, 1)
@@ -107,7 +214,205 @@ func (a *UserDataAccessor) FindByUserID(reqUserID string, option FindOption) ([]
 	return res, ErrorOther
 }
 
+// Create はユーザーを新規作成します。IDは自動で採番されます。
+func (a *UserDataAccessor) Create(reqUser User) (User, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqUser}
+	cmd := command{commandCreate, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[UserID=%s] Create Error. [%s]", reqUser.UserID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[UserID=%s] Create Error. [%s]", reqUser.UserID, ErrorOther)
+	return res, ErrorOther
+}
+
+// Update はIDが一致するユーザーの情報を更新します。
+func (a *UserDataAccessor) Update(reqUser User) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqUser}
+	cmd := command{commandUpdate, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Update Error. [%s]", reqUser.ID, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// Modify はIDが一致するユーザーの最新の情報を fn で変更して保存し、変更後の情報を返します。
+// fn はメインループの中で実行されるため、他の更新と競合せずに必要な項目だけを変更できます。
+// fn がエラーを返した場合は保存せずに、そのエラーを返します。
+// fn の中では、パスワードのハッシュ化などの時間のかかる処理は行わないでください。
+func (a *UserDataAccessor) Modify(reqID ID, fn func(user *User) error) (User, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqID, fn}
+	cmd := command{commandModify, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Modify Error. [%s]", reqID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[ID=%s] Modify Error. [%s]", reqID, ErrorOther)
+	return res, ErrorOther
+}
+
+// Delete はIDが一致するユーザーを削除します。
+func (a *UserDataAccessor) Delete(reqID ID) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqID}
+	cmd := command{commandDelete, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Delete Error. [%s]", reqID, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// IssueRememberToken はログインしたままにするトークンを新しく発行します。
+// トークンの系列と検証値を返します。
+func (a *UserDataAccessor) IssueRememberToken(reqID ID, expire time.Time) (string, string, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqID, expire}
+	cmd := command{commandIssueRememberToken, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Issue Remember Token Error. [%s]", reqID, resp.err)
+		return "", "", resp.err
+	}
+	family, ok1 := resp.result[0].(string)
+	validator, ok2 := resp.result[1].(string)
+	if ok1 && ok2 {
+		return family, validator, nil
+	}
+	e.Logger.Debugf("User[ID=%s] Issue Remember Token Error. [%s]", reqID, ErrorOther)
+	return "", "", ErrorOther
+}
+
+// RotateRememberToken はログインしたままにするトークンを確認し、
+// 新しい検証値に置き換えます。ユーザーと新しい検証値を返します。
+// 置き換え済みの検証値が使われた場合は、系列ごと無効にして
+// ErrorRememberTokenReused を返します。
+func (a *UserDataAccessor) RotateRememberToken(reqID ID, family string, validator string, expire time.Time) (User, string, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqID, family, validator, expire}
+	cmd := command{commandRotateRememberToken, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Rotate Remember Token Error. [%s]", reqID, resp.err)
+		return res, "", resp.err
+	}
+	user, ok1 := resp.result[0].(User)
+	newValidator, ok2 := resp.result[1].(string)
+	if ok1 && ok2 {
+		return user, newValidator, nil
+	}
+	e.Logger.Debugf("User[ID=%s] Rotate Remember Token Error. [%s]", reqID, ErrorOther)
+	return res, "", ErrorOther
+}
+
+// RevokeRememberToken はログインしたままにするトークンを系列ごと無効にします。
+// familyが空の場合は、ユーザーの全てのトークンを無効にします。
+func (a *UserDataAccessor) RevokeRememberToken(reqID ID, family string) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{reqID, family}
+	cmd := command{commandRevokeRememberToken, req, respCh}
+	a.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Revoke Remember Token Error. [%s]", reqID, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// ConsumeTOTPStep は、TOTPのコードが一致したステップを使用済みとして記録します。
+// 同時に送られたリクエストなどで、既にそのステップ以降が使用されていた場合は
+// ErrorTOTPCodeUsed を返します。
+func (a *UserDataAccessor) ConsumeTOTPStep(reqID ID, step int64) error {
+	_, err := a.Modify(reqID, func(u *User) error {
+		if step <= u.TOTPLastStep {
+			return ErrorTOTPCodeUsed
+		}
+		u.TOTPLastStep = step
+		return nil
+	})
+	return err
+}
+
+// ConsumeRecoveryCode は、リカバリーコードを確認し、一致したコードを使用済みとして
+// 取り除きます。一致しない場合や、同時に送られたリクエストなどで既に使用されていた場合は
+// ErrorRecoveryCodeInvalid を返します。
+// 時間のかかるハッシュの確認はメインループの外で行い、取り除く処理のみをメインループで行います。
+func (a *UserDataAccessor) ConsumeRecoveryCode(user User, code string) error {
+	hash, ok := user.matchRecoveryCode(code)
+	if !ok {
+		return ErrorRecoveryCodeInvalid
+	}
+	_, err := a.Modify(user.ID, func(u *User) error {
+		for i, x := range u.RecoveryCodes {
+			if x == hash {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrorRecoveryCodeInvalid
+	})
+	return err
+}
+
+// SessionGeneration は、ユーザーのセッションの世代と、世代を進めた際に
+// 引き継いだセッションの識別子を返します（session.Generations）。
+func (a *UserDataAccessor) SessionGeneration(userID string) (int64, string, error) {
+	users, err := a.FindByUserID(userID, FindFirst)
+	if err != nil {
+		return 0, "", err
+	}
+	return users[0].SessionGeneration, users[0].SessionKeep, nil
+}
+
+// AdvanceSessionGeneration は、ユーザーのセッションの世代を進め、
+// それまでのセッションを無効にします（session.Generations）。
+// keep が空でない場合は、その識別子のセッションを引き継ぎます。
+func (a *UserDataAccessor) AdvanceSessionGeneration(userID string, keep string) error {
+	users, err := a.FindByUserID(userID, FindFirst)
+	if err != nil {
+		return err
+	}
+	_, err = a.Modify(users[0].ID, func(u *User) error {
+		u.SessionGeneration++
+		u.SessionKeep = keep
+		return nil
+	})
+	return err
+}
+
 // EncodeStringMD5 は、MD5エンコードした文字列を返します。
+// 旧形式のパスワードハッシュの検証にのみ使用します。
 func EncodeStringMD5(str string) StringMD5 {
 	h := md5.New()
 	io.WriteString(h, str)
@@ -131,43 +436,31 @@ const (
 var (
 	ErrorNotFound        = errors.New("Not found")
 	ErrorMultipleResults = errors.New("Multiple results")
+	ErrorDuplicateUserID = errors.New("Duplicate UserID")
 	ErrorInvalidCommand  = errors.New("Invalid Command")
 	ErrorBadParameter    = errors.New("Bad Parameter")
 	ErrorNotImplemented  = errors.New("Not Implemented")
 	ErrorOther           = errors.New("Other")
 )
 
-func (a *UserDataAccessor) decodeJSON() error {
-	// JSONファイル読み込み
-	bytes, err := ioutil.ReadFile("data/users.json")
-	if err != nil {
-		return err
-	}
-	// JSONをデコードする
-	var records []User
-	if err := json.Unmarshal(bytes, &records); err != nil {
-		return err
-	}
-	// 結果をmapにセットする
-	for _, x := range records {
-		users[x.ID] = x
-	}
-	return nil
-}
-
 // echoのインスタンス
 var e *echo.Echo
 
-// 情報をメモリ上に持つためのmap
-var users map[ID]User
-
 // コマンド種別の定義
 type commandType int
 
 const (
-	commandFindAll      commandType = iota // 全件検索
-	commandFindByID                        // IDで検索
-	commandFindByUserID                    // UserIDで検索
+	commandFindAll             commandType = iota // 全件検索
+	commandFindByID                               // IDで検索
+	commandFindByUserID                           // UserIDで検索
+	commandCreate                                 // 新規作成
+	commandUpdate                                 // 更新
+	commandDelete                                 // 削除
+	commandModify                                 // 最新の情報を読み出して変更
+	commandFind                                   // 条件を指定して検索
+	commandIssueRememberToken                     // ログインしたままにするトークンの発行
+	commandRotateRememberToken                    // ログインしたままにするトークンの置き換え
+	commandRevokeRememberToken                    // ログインしたままにするトークンの無効化
 )
 
 // コマンド実行のためのパラメータ
@@ -185,8 +478,6 @@ type response struct {
 
 // UserDataAccessor のメインループ処理
 func (a *UserDataAccessor) mainLoop() {
-	a.stopCh = make(chan struct{}, 1)
-	a.commandCh = make(chan command, 1)
 	defer close(a.commandCh)
 	defer close(a.stopCh)
 	e.Logger.Info("model.UserDataAccessor:start")
@@ -199,7 +490,7 @@ loop:
 			// 全件検索
 			case commandFindAll:
 				results := []User{}
-				for _, x := range users {
+				for _, x := range a.users {
 					user := User{}
 					user.Copy(&x)
 					results = append(results, user)
@@ -207,11 +498,48 @@ loop:
 				res := []interface{}{results}
 				cmd.responseCh <- response{res, nil}
 				break
+			// 条件を指定して検索
+			case commandFind:
+				reqQuery, ok := cmd.req[0].(UserQuery)
+				if !ok || reqQuery.Offset < 0 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				if reqQuery.SortBy != "" && reqQuery.SortBy != SortByUserID && reqQuery.SortBy != SortByFullName {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				matches := []User{}
+				for _, x := range a.users {
+					if reqQuery.match(&x) {
+						matches = append(matches, x)
+					}
+				}
+				reqQuery.sort(matches)
+				results := []User{}
+				for _, x := range reqQuery.page(matches) {
+					user := User{}
+					user.Copy(&x)
+					results = append(results, user)
+				}
+				res := []interface{}{UserQueryResult{results, len(matches)}}
+				cmd.responseCh <- response{res, nil}
 			// IDで検索
 			case commandFindByID:
-				// 未実装
-				cmd.responseCh <- response{nil, ErrorNotImplemented}
-				break
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := a.users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				user := User{}
+				user.Copy(&x)
+				res := []interface{}{user}
+				cmd.responseCh <- response{res, nil}
 			// UserIDで検索
 			case commandFindByUserID:
 				reqUserID, ok := cmd.req[0].(string)
@@ -219,31 +547,225 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				reqOption, ok := cmd.req[1].(FindOption)
+				// UserIDは一意なので、どのオプションでも結果は最大1件になる
+				if _, ok := cmd.req[1].(FindOption); !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				id, ok := a.userIDIndex[reqUserID]
 				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				x := a.users[id]
+				user := User{}
+				user.Copy(&x)
+				results := []User{user}
+				res := []interface{}{results}
+				cmd.responseCh <- response{res, nil}
+			// 新規作成
+			case commandCreate:
+				reqUser, ok := cmd.req[0].(User)
+				if !ok || reqUser.UserID == "" {
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				results := []User{}
-				for _, x := range users {
-					if x.UserID == reqUserID {
-						user := User{}
-						user.Copy(&x)
-						results = append(results, user)
-						if reqOption == FindFirst {
-							break
-						}
-					}
+				if a.existsUserID(reqUser.UserID, "") {
+					cmd.responseCh <- response{nil, ErrorDuplicateUserID}
+					break
+				}
+				user := User{}
+				user.Copy(&reqUser)
+				user.ID = ID(uuid.NewV4().String())
+				if err := a.store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
 				}
-				if len(results) <= 0 {
+				a.users[user.ID] = user
+				a.userIDIndex[user.UserID] = user.ID
+				result := User{}
+				result.Copy(&user)
+				e.Logger.Debugf("User[ID=%s] Create. UserID[%s]", user.ID, user.UserID)
+				res := []interface{}{result}
+				cmd.responseCh <- response{res, nil}
+			// 更新
+			case commandUpdate:
+				reqUser, ok := cmd.req[0].(User)
+				if !ok || reqUser.UserID == "" {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				oldUser, ok := a.users[reqUser.ID]
+				if !ok {
 					cmd.responseCh <- response{nil, ErrorNotFound}
 					break
 				}
-				if reqOption == FindUnique && len(results) > 1 {
-					cmd.responseCh <- response{nil, ErrorMultipleResults}
+				if a.existsUserID(reqUser.UserID, reqUser.ID) {
+					cmd.responseCh <- response{nil, ErrorDuplicateUserID}
 					break
 				}
-				res := []interface{}{results}
+				user := User{}
+				user.Copy(&reqUser)
+				if err := a.store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.users[user.ID] = user
+				delete(a.userIDIndex, oldUser.UserID)
+				a.userIDIndex[user.UserID] = user.ID
+				e.Logger.Debugf("User[ID=%s] Update. UserID[%s]", user.ID, user.UserID)
+				cmd.responseCh <- response{nil, nil}
+			// 削除
+			case commandDelete:
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				oldUser, ok := a.users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				if err := a.store.Delete(reqID); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				delete(a.users, reqID)
+				delete(a.userIDIndex, oldUser.UserID)
+				e.Logger.Debugf("User[ID=%s] Delete.", reqID)
+				cmd.responseCh <- response{nil, nil}
+			// ログインしたままにするトークンの発行
+			case commandIssueRememberToken:
+				reqID, ok1 := cmd.req[0].(ID)
+				reqExpire, ok2 := cmd.req[1].(time.Time)
+				if !ok1 || !ok2 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := a.users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				user := User{}
+				user.Copy(&x)
+				family, validator, err := user.issueRememberToken(time.Now(), reqExpire)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				if err := a.store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.users[user.ID] = user
+				e.Logger.Debugf("User[ID=%s] Issue Remember Token. expire[%s]", user.ID, reqExpire)
+				res := []interface{}{family, validator}
+				cmd.responseCh <- response{res, nil}
+			// ログインしたままにするトークンの置き換え
+			case commandRotateRememberToken:
+				reqID, ok1 := cmd.req[0].(ID)
+				reqFamily, ok2 := cmd.req[1].(string)
+				reqValidator, ok3 := cmd.req[2].(string)
+				reqExpire, ok4 := cmd.req[3].(time.Time)
+				if !ok1 || !ok2 || !ok3 || !ok4 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := a.users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				user := User{}
+				user.Copy(&x)
+				newValidator, rotateErr := user.rotateRememberToken(reqFamily, reqValidator, time.Now(), reqExpire)
+				if rotateErr != nil && rotateErr != ErrorRememberTokenReused {
+					cmd.responseCh <- response{nil, rotateErr}
+					break
+				}
+				// 盗用を検出した場合も、系列を削除した結果を保存する
+				if err := a.store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.users[user.ID] = user
+				if rotateErr != nil {
+					e.Logger.Warnf("User[ID=%s] Remember Token Reused. Family revoked.", user.ID)
+					cmd.responseCh <- response{nil, rotateErr}
+					break
+				}
+				result := User{}
+				result.Copy(&user)
+				e.Logger.Debugf("User[ID=%s] Rotate Remember Token. expire[%s]", user.ID, reqExpire)
+				res := []interface{}{result, newValidator}
+				cmd.responseCh <- response{res, nil}
+			// ログインしたままにするトークンの無効化
+			case commandRevokeRememberToken:
+				reqID, ok1 := cmd.req[0].(ID)
+				reqFamily, ok2 := cmd.req[1].(string)
+				if !ok1 || !ok2 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := a.users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				user := User{}
+				user.Copy(&x)
+				user.revokeRememberToken(reqFamily)
+				if err := a.store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.users[user.ID] = user
+				e.Logger.Debugf("User[ID=%s] Revoke Remember Token.", user.ID)
+				cmd.responseCh <- response{nil, nil}
+			// 最新の情報を読み出して変更
+			case commandModify:
+				reqID, ok1 := cmd.req[0].(ID)
+				reqFn, ok2 := cmd.req[1].(func(user *User) error)
+				if !ok1 || !ok2 || reqFn == nil {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := a.users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				modified := User{}
+				modified.Copy(&x)
+				if err := reqFn(&modified); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				// IDは変更できない
+				modified.ID = x.ID
+				if modified.UserID == "" {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				if a.existsUserID(modified.UserID, modified.ID) {
+					cmd.responseCh <- response{nil, ErrorDuplicateUserID}
+					break
+				}
+				user := User{}
+				user.Copy(&modified)
+				if err := a.store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.users[user.ID] = user
+				delete(a.userIDIndex, x.UserID)
+				a.userIDIndex[user.UserID] = user.ID
+				result := User{}
+				result.Copy(&user)
+				e.Logger.Debugf("User[ID=%s] Modify. UserID[%s]", user.ID, user.UserID)
+				res := []interface{}{result}
 				cmd.responseCh <- response{res, nil}
 			// それ以外（エラー）
 			default:
@@ -253,5 +775,14 @@ loop:
 			break loop
 		}
 	}
+	if err := a.store.Close(); err != nil {
+		e.Logger.Debugf("User Store Close Error. [%s]", err)
+	}
 	e.Logger.Info("model.UserDataAccessor:stop")
 }
+
+// 指定されたUserIDが既に使われているか確認する（exceptIDのユーザーは除く）
+func (a *UserDataAccessor) existsUserID(userID string, exceptID ID) bool {
+	id, ok := a.userIDIndex[userID]
+	return ok && id != exceptID
+}
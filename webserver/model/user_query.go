@@ -0,0 +1,80 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// UserQuery はユーザー検索の条件です。
+type UserQuery struct {
+	Role    Role        // 指定された権限を持つユーザーのみを返す（空の場合は全て）
+	Keyword string      // FullName または UserID の部分一致（大文字・小文字は区別しない）
+	SortBy  UserSortKey // 並び順のキー（空の場合はUserID順）
+	Desc    bool        // trueの場合は降順
+	Offset  int         // 先頭から読み飛ばす件数
+	Limit   int         // 返す最大件数（0以下の場合は全件）
+}
+
+// UserQueryResult はユーザー検索の結果です。
+type UserQueryResult struct {
+	Users []User // Offset / Limit を適用した結果
+	Total int    // Offset / Limit を適用する前の件数
+}
+
+// UserSortKey はユーザー検索結果の並び順のキーです。
+type UserSortKey string
+
+// 並び順のキーの定義
+const (
+	SortByUserID   UserSortKey = "user_id"
+	SortByFullName UserSortKey = "full_name"
+)
+
+// ユーザーが検索条件に一致するか確認する
+func (q *UserQuery) match(u *User) bool {
+	if q.Role != "" && !u.HasRole(q.Role) {
+		return false
+	}
+	if q.Keyword != "" {
+		keyword := strings.ToLower(q.Keyword)
+		if !strings.Contains(strings.ToLower(u.UserID), keyword) &&
+			!strings.Contains(strings.ToLower(u.FullName), keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// 検索結果を並び替える
+func (q *UserQuery) sort(users []User) {
+	less := func(i, j int) bool {
+		return users[i].UserID < users[j].UserID
+	}
+	if q.SortBy == SortByFullName {
+		less = func(i, j int) bool {
+			if users[i].FullName == users[j].FullName {
+				return users[i].UserID < users[j].UserID
+			}
+			return users[i].FullName < users[j].FullName
+		}
+	}
+	if q.Desc {
+		sort.Slice(users, func(i, j int) bool { return less(j, i) })
+		return
+	}
+	sort.Slice(users, less)
+}
+
+// 検索結果から Offset / Limit の範囲を切り出す
+func (q *UserQuery) page(users []User) []User {
+	if q.Offset >= len(users) {
+		return []User{}
+	}
+	if q.Offset > 0 {
+		users = users[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(users) {
+		users = users[:q.Limit]
+	}
+	return users
+}
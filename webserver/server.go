@@ -8,6 +8,7 @@ import (
 	"syscall"
 	"time"
 
+	"./lockout"
 	"./model"
 	"./session"
 	"./setting"
@@ -20,11 +21,15 @@ import (
 var templates map[string]*template.Template
 
 // セッション管理のインスタンス
-var sessionManager *session.Manager
+var sessionManager session.Provider
 
 // データアクセサのインスタンス
 var userDA *model.UserDataAccessor
 
+// ログイン試行回数制限のインスタンス（ユーザーID毎・IPアドレス毎）
+var userLimiter *lockout.Limiter
+var ipLimiter *lockout.Limiter
+
 func main() {
 	// Echoのインスタンスを生成
 	e := echo.New()
@@ -37,9 +42,18 @@ func main() {
 	t := &Template{}
 	e.Renderer = t
 
+	// セッション管理を開始
+	sessionManager = session.NewProvider()
+	if err := sessionManager.Start(e); err != nil {
+		e.Logger.Fatal(err)
+	}
+
 	// ミドルウェアを設定
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(session.Middleware(sessionManager))
+	e.Use(MiddlewareCSRF)
+	e.Use(MiddlewareRememberLogin)
 
 	// 静的ファイルを配置するルーティングを設定
 	setStaticRoute(e)
@@ -47,13 +61,43 @@ func main() {
 	// 各ルーティングに対するハンドラを設定
 	setRoute(e)
 
-	// セッション管理を開始
-	sessionManager = &session.Manager{}
-	sessionManager.Start(e)
-
 	// データアクセサの開始
 	userDA = &model.UserDataAccessor{}
-	userDA.Start(e)
+	if err := userDA.Start(e); err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Cookieにセッションを保存する場合は、ユーザー毎のセッションの世代をユーザー情報に保存する
+	// セッションの一覧を持たないため、同時にログインできるセッション数の上限は設定できない
+	if cookieManager, ok := sessionManager.(*session.CookieManager); ok {
+		for role, n := range setting.Login.MaxSessions {
+			if n > 0 {
+				e.Logger.Fatalf("Login.MaxSessions[%s] can not be used with cookie session storage.", role)
+			}
+		}
+		cookieManager.SetGenerations(userDA)
+	}
+
+	// パスワードポリシーの読み込み
+	if err := model.LoadPasswordPolicy(); err != nil {
+		e.Logger.Error(err)
+	}
+
+	// ログイン試行回数制限の開始
+	userLimiter = &lockout.Limiter{}
+	userLimiter.Start(e, lockout.Config{
+		MaxFailures:   setting.Login.UserMaxFailures,
+		BaseDuration:  setting.Login.LockoutBase,
+		MaxDuration:   setting.Login.LockoutMax,
+		FailureWindow: setting.Login.FailureWindow,
+	})
+	ipLimiter = &lockout.Limiter{}
+	ipLimiter.Start(e, lockout.Config{
+		MaxFailures:   setting.Login.IPMaxFailures,
+		BaseDuration:  setting.Login.LockoutBase,
+		MaxDuration:   setting.Login.LockoutMax,
+		FailureWindow: setting.Login.FailureWindow,
+	})
 
 	// サーバーを開始
 	go func() {
@@ -74,6 +118,10 @@ func main() {
 		e.Close()
 	}
 
+	// ログイン試行回数制限の停止
+	ipLimiter.Stop()
+	userLimiter.Stop()
+
 	// データアクセサの停止
 	userDA.Stop()
 
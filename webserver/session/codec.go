@@ -0,0 +1,116 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// Codec は 文字列以外の値をデータストアに保存する際の変換方式です。
+type Codec interface {
+	Encode(v interface{}) (string, error)
+	Decode(s string, v interface{}) error
+}
+
+// 変換方式
+var (
+	JSONCodec Codec = jsonCodec{} // JSON
+	GobCodec  Codec = gobCodec{}  // gob（Base64エンコードして保存する）
+)
+
+// キー毎の変換方式と大きさの上限
+type keyConfig struct {
+	codec   Codec
+	maxSize int
+}
+
+var (
+	keyConfigs   = make(map[string]keyConfig)
+	keyConfigsMu sync.RWMutex
+)
+
+// RegisterKey は データストアのキーに保存する値の変換方式と、
+// 変換後の大きさの上限（バイト、0以下の場合は無制限）を登録します。
+// Get・Set で使用するキーは、事前に登録しておく必要があります。
+func RegisterKey(key string, codec Codec, maxSize int) {
+	keyConfigsMu.Lock()
+	defer keyConfigsMu.Unlock()
+	keyConfigs[key] = keyConfig{codec, maxSize}
+}
+
+func lookupKey(key string) (keyConfig, bool) {
+	keyConfigsMu.RLock()
+	defer keyConfigsMu.RUnlock()
+	cfg, ok := keyConfigs[key]
+	return cfg, ok
+}
+
+// Set は 値を登録された方式で変換し、データストアに保存します。
+// 変換後の大きさが上限を超える場合は ErrorTooLarge を返します。
+// 保存した値は、文字列の値と同様に SaveStore で保存されます。
+func (s *Store) Set(key string, v interface{}) error {
+	cfg, ok := lookupKey(key)
+	if !ok {
+		return ErrorNotRegistered
+	}
+	encoded, err := cfg.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	if cfg.maxSize > 0 && len(encoded) > cfg.maxSize {
+		return ErrorTooLarge
+	}
+	if s.Data == nil {
+		s.Data = make(map[string]string)
+	}
+	s.Data[key] = encoded
+	return nil
+}
+
+// Get は データストアの値を登録された方式で変換し、v（ポインタ）に読み出します。
+// 値が保存されていない場合は ErrorNotFound を返します。
+func (s *Store) Get(key string, v interface{}) error {
+	cfg, ok := lookupKey(key)
+	if !ok {
+		return ErrorNotRegistered
+	}
+	encoded, ok := s.Data[key]
+	if !ok {
+		return ErrorNotFound
+	}
+	return cfg.codec.Decode(encoded, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (jsonCodec) Decode(s string, v interface{}) error {
+	return json.Unmarshal([]byte(s), v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (gobCodec) Decode(s string, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -2,29 +2,111 @@ package session
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"../setting"
 	"github.com/labstack/echo"
 )
 
+// Cookie名の接頭辞
+const (
+	CookiePrefixSecure = "__Secure-" // Secure属性が必須
+	CookiePrefixHost   = "__Host-"   // Secure属性が必須・Path=/・Domain属性なし
+)
+
 // WriteCookie は、ブラウザのcookieにセッションIDを書き込みます。
 func WriteCookie(c echo.Context, sessionID ID) error {
-	cookie := new(http.Cookie)
-	cookie.Name = setting.Session.CookieName
+	cookie := NewCookie(setting.Session.CookieName)
 	cookie.Value = string(sessionID)
 	cookie.Expires = time.Now().Add(setting.Session.CookieExpire)
 	c.SetCookie(cookie)
 	return nil
 }
 
+// DeleteCookie は、ブラウザのcookieからセッションIDを削除します。
+func DeleteCookie(c echo.Context) error {
+	cookie := NewCookie(setting.Session.CookieName)
+	cookie.Value = ""
+	cookie.Expires = time.Unix(0, 0)
+	cookie.MaxAge = -1
+	c.SetCookie(cookie)
+	return nil
+}
+
 // ReadCookie は、ブラウザのcookieからセッションIDを読み込みます。
 func ReadCookie(c echo.Context) (ID, error) {
 	var sessionID ID
-	cookie, err := c.Cookie(setting.Session.CookieName)
+	cookie, err := c.Cookie(CookieName(setting.Session.CookieName))
 	if err != nil {
 		return sessionID, err
 	}
 	sessionID = ID(cookie.Value)
 	return sessionID, nil
 }
+
+// NewCookie は、セッションのCookieと同じ属性を設定したCookieを生成します。
+// name には接頭辞を含まないCookie名を指定します。
+func NewCookie(name string) *http.Cookie {
+	cookie := new(http.Cookie)
+	cookie.Name = CookieName(name)
+	cookie.Path = setting.Session.CookiePath
+	cookie.Domain = setting.Session.CookieDomain
+	cookie.Secure = setting.Session.CookieSecure
+	cookie.HttpOnly = setting.Session.CookieHTTPOnly
+	cookie.SameSite = setting.Session.CookieSameSite
+	// 接頭辞を付けた場合は、ブラウザに拒否されないよう必須の属性に揃える
+	switch setting.Session.CookiePrefix {
+	case CookiePrefixHost:
+		cookie.Secure = true
+		cookie.Path = "/"
+		cookie.Domain = ""
+	case CookiePrefixSecure:
+		cookie.Secure = true
+	}
+	return cookie
+}
+
+// CookieName は、設定された接頭辞を含めたCookie名を返します。
+func CookieName(name string) string {
+	prefix := setting.Session.CookiePrefix
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// Save は、データストアを保存します。
+// Provider が Resealer の場合は、新しいセッションIDをCookieに書き込みます。
+func Save(c echo.Context, p Provider, sessionID ID, sessionStore Store) error {
+	r, ok := p.(Resealer)
+	if !ok {
+		saver, ok := p.(Saver)
+		if !ok {
+			return ErrorNotImplemented
+		}
+		return saver.SaveStore(sessionID, sessionStore)
+	}
+	newSessionID, err := r.Reseal(sessionID, sessionStore)
+	if err != nil {
+		return err
+	}
+	return WriteCookie(c, newSessionID)
+}
+
+// Update は、データストアを読み出して fn で変更し、保存します。
+// Provider が Resealer の場合は、新しいセッションIDをCookieに書き込みます。
+// Provider が Saver の場合は Saver の Update を使用し、保存の競合時は再試行します。
+func Update(c echo.Context, p Provider, sessionID ID, fn func(sessionStore *Store) error) error {
+	if saver, ok := p.(Saver); ok {
+		return saver.Update(sessionID, fn)
+	}
+	sessionStore, err := p.LoadStore(sessionID)
+	if err != nil {
+		return err
+	}
+	if err := fn(&sessionStore); err != nil {
+		return err
+	}
+	return Save(c, p, sessionID, sessionStore)
+}
@@ -0,0 +1,378 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"../setting"
+	"github.com/labstack/echo"
+)
+
+// CookieManager は サーバー側に状態を持たず、セッションの内容を
+// 暗号化してCookieに保存する Provider です。
+// セッションIDは暗号化したセッションの内容そのもので、内容が変わる度に
+// IDも変わるため、保存は Save を使用してCookieを書き直す必要があります。
+// 読み出しでは有効期限を延長できないため、Request が読み出した際に
+// 有効期限が近づいていれば、保存し直してCookieを書き直します。
+//
+// 暗号化にはAES-GCMを使用し、setting.Session.CookieKeys の先頭の鍵で暗号化、
+// 全ての鍵で復号を試みます。鍵を入れ替える際は新しい鍵を先頭に追加し、
+// 古い鍵で暗号化されたCookieが期限切れになってから古い鍵を削除してください。
+//
+// サーバー側に状態を持たないため、ConsistencyToken は同じCookieから
+// 派生した保存の競合のみを検出し、古いCookieの再送は防げません。
+//
+// ユーザーのセッションをまとめて無効にするため、ログインしたセッションには
+// ユーザー毎のセッションの世代を記録し、読み出しの際に SetGenerations で
+// 設定した Generations の現在の世代と比べます。世代を進めると、それまでに
+// 発行したCookieは全て無効になります。セッションの一覧は持たないため、
+// ListByUser・DeleteByKey・List は使用できません。
+type CookieManager struct {
+	keys        []cookieKey
+	generations Generations
+}
+
+// Generations は ユーザー毎のセッションの世代を保存します。
+// CookieManager で DeleteByUser・DeleteAllExceptCurrent を使用する場合に、
+// 全てのサーバーから参照できる保存先（ユーザー情報など）を設定します。
+type Generations interface {
+	// SessionGeneration は ユーザーの現在の世代と、世代を進めた際に
+	// 引き継いだセッションの識別子を返します。
+	SessionGeneration(userID string) (int64, string, error)
+	// AdvanceSessionGeneration は ユーザーの世代を進めます。
+	// keep が空でない場合は、その識別子のセッションを引き継ぎます。
+	AdvanceSessionGeneration(userID string, keep string) error
+}
+
+// 暗号化の鍵
+type cookieKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Cookieに保存する際のセッションの形式
+type cookieRecord struct {
+	Data             map[string]string `json:"d"`
+	ConsistencyToken string            `json:"t"`
+	Created          int64             `json:"c"`
+	Expire           int64             `json:"x"`
+	// セッションの識別子（保存しても変わらず、Regenerate で作り直す）
+	SID string `json:"s"`
+	// ログインしているユーザーのセッションの世代
+	Generation int64 `json:"g,omitempty"`
+}
+
+// 暗号化したセッションの形式
+const (
+	cookieVersion   byte = 1
+	cookieKeyIDLen       = 4
+	cookieMaxLength      = 4000 // ブラウザが保存できるCookieの大きさの目安
+)
+
+// 暗号化の追加認証データ（他の用途の暗号文を流用されないようにする）
+var cookieAdditionalData = []byte("gowebserver session")
+
+// CookieManagerが返す各エラーのインスタンスを生成します。
+var (
+	ErrorNoCookieKey = errors.New("No Cookie Key")
+)
+
+// Start は CookieManagerの開始を行います。
+func (m *CookieManager) Start(echo *echo.Echo) error {
+	setEcho(echo)
+	m.keys = nil
+	for _, encoded := range setting.Session.CookieKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		// AES-256を使用する
+		if len(key) != 32 {
+			return ErrorBadParameter
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(key)
+		m.keys = append(m.keys, cookieKey{sum[:cookieKeyIDLen], aead})
+	}
+	if len(m.keys) == 0 {
+		return ErrorNoCookieKey
+	}
+	e.Logger.Info("session.CookieManager:start")
+	return nil
+}
+
+// Stop は CookieManagerの停止を行います。
+func (m *CookieManager) Stop() {
+	e.Logger.Info("session.CookieManager:stop")
+}
+
+// SetGenerations は ユーザー毎のセッションの世代の保存先を設定します。
+// Start の後、リクエストを受け付ける前に呼び出します。
+func (m *CookieManager) SetGenerations(generations Generations) {
+	m.generations = generations
+}
+
+// Create は セッションの作成を行います。
+func (m *CookieManager) Create() (ID, error) {
+	now := time.Now()
+	record := cookieRecord{
+		Data:             map[string]string{},
+		ConsistencyToken: createToken(),
+		Created:          now.Unix(),
+		Expire:           nextExpire(now, now).Unix(),
+		SID:              createToken(),
+	}
+	sessionID, err := m.seal(record)
+	if err != nil {
+		e.Logger.Debugf("Session Create Error. [%s]", err)
+		return sessionID, err
+	}
+	return sessionID, nil
+}
+
+// LoadStore は データストアの読み出しを行います。
+func (m *CookieManager) LoadStore(sessionID ID) (Store, error) {
+	var res Store
+	record, _, err := m.openCurrent(sessionID)
+	if err != nil {
+		e.Logger.Debugf("Session Load store Error. [%s]", err)
+		return res, err
+	}
+	sessionData := make(map[string]string)
+	for k, v := range record.Data {
+		sessionData[k] = v
+	}
+	res.Data = sessionData
+	res.ConsistencyToken = record.ConsistencyToken
+	res.Created = time.Unix(record.Created, 0)
+	res.Expire = time.Unix(record.Expire, 0)
+	return res, nil
+}
+
+// Reseal は データストアの内容を暗号化し直して新しいセッションIDを返します。
+func (m *CookieManager) Reseal(sessionID ID, sessionStore Store) (ID, error) {
+	var res ID
+	record, generation, err := m.openCurrent(sessionID)
+	if err != nil {
+		e.Logger.Debugf("Session Reseal Error. [%s]", err)
+		return res, err
+	}
+	if record.ConsistencyToken != sessionStore.ConsistencyToken {
+		e.Logger.Debugf("Session Reseal Error. [%s]", ErrorInvalidToken)
+		return res, ErrorInvalidToken
+	}
+	// ログインしたユーザーが変わる場合は、そのユーザーの現在の世代を記録する
+	if userID := sessionStore.Data[UserIDKey]; userID != record.Data[UserIDKey] {
+		generation, _, err = m.generation(userID)
+		if err != nil {
+			e.Logger.Debugf("Session Reseal Error. [%s]", err)
+			return res, err
+		}
+	}
+	sessionData := make(map[string]string)
+	for k, v := range sessionStore.Data {
+		sessionData[k] = v
+	}
+	record.Data = sessionData
+	record.Generation = generation
+	record.ConsistencyToken = createToken()
+	record.Expire = nextExpire(time.Unix(record.Created, 0), time.Now()).Unix()
+	res, err = m.seal(record)
+	if err != nil {
+		e.Logger.Debugf("Session Reseal Error. [%s]", err)
+		return res, err
+	}
+	return res, nil
+}
+
+// Regenerate は セッションIDの再発行を行います。
+// サーバー側に状態を持たないため、元のIDを無効にすることはできませんが、
+// ConsistencyToken を作り直すため、元のIDからの保存は競合として拒否されます。
+func (m *CookieManager) Regenerate(sessionID ID) (ID, error) {
+	var res ID
+	record, generation, err := m.openCurrent(sessionID)
+	if err != nil {
+		e.Logger.Debugf("Session Regenerate Error. [%s]", err)
+		return res, err
+	}
+	record.ConsistencyToken = createToken()
+	record.SID = createToken()
+	record.Generation = generation
+	record.Expire = nextExpire(time.Unix(record.Created, 0), time.Now()).Unix()
+	res, err = m.seal(record)
+	if err != nil {
+		e.Logger.Debugf("Session Regenerate Error. [%s]", err)
+		return res, err
+	}
+	return res, nil
+}
+
+// SetClient は 接続元の情報の記録を行います。
+// CookieManager ではセッションの一覧を持たないため使用できません。
+func (m *CookieManager) SetClient(sessionID ID, ip string, userAgent string) error {
+	return ErrorNotImplemented
+}
+
+// ListByUser は ユーザーのセッションの一覧を返します。
+// CookieManager ではセッションの一覧を持たないため使用できません。
+func (m *CookieManager) ListByUser(userID string) ([]Info, error) {
+	return nil, ErrorNotImplemented
+}
+
+// DeleteByUser は ユーザーのセッションを全て削除します。
+// ユーザーのセッションの世代を進め、発行済みのCookieを全て無効にします。
+// Generations を設定していない場合は ErrorNotImplemented を返します。
+func (m *CookieManager) DeleteByUser(userID string) error {
+	if m.generations == nil {
+		return ErrorNotImplemented
+	}
+	if err := m.generations.AdvanceSessionGeneration(userID, ""); err != nil {
+		e.Logger.Debugf("User[%s] Session Delete Error. [%s]", userID, err)
+		return err
+	}
+	return nil
+}
+
+// DeleteAllExceptCurrent は 現在のセッション以外のユーザーのセッションを全て削除します。
+// ユーザーのセッションの世代を進め、現在のセッションのみを引き継ぎます。
+// Generations を設定していない場合は ErrorNotImplemented を返します。
+func (m *CookieManager) DeleteAllExceptCurrent(userID string, currentID ID) error {
+	if m.generations == nil {
+		return ErrorNotImplemented
+	}
+	keep := ""
+	if record, _, err := m.openCurrent(currentID); err == nil && record.Data[UserIDKey] == userID {
+		keep = record.SID
+	}
+	if err := m.generations.AdvanceSessionGeneration(userID, keep); err != nil {
+		e.Logger.Debugf("User[%s] Session Delete Error. [%s]", userID, err)
+		return err
+	}
+	return nil
+}
+
+// DeleteByKey は Keyが一致するユーザーのセッションを削除します。
+// CookieManager ではセッションの一覧を持たないため使用できません。
+func (m *CookieManager) DeleteByKey(userID string, key string) error {
+	return ErrorNotImplemented
+}
+
+// List は 条件に一致するセッションの一覧を返します。
+// CookieManager ではセッションの一覧を持たないため使用できません。
+func (m *CookieManager) List(query ListQuery) (ListResult, error) {
+	return ListResult{}, ErrorNotImplemented
+}
+
+// Delete は セッションの削除を行います。
+// サーバー側には何も保存していないため、Cookieを削除するだけで十分です。
+func (m *CookieManager) Delete(sessionID ID) error {
+	if _, err := m.open(sessionID); err != nil {
+		e.Logger.Debugf("Session Delete Error. [%s]", err)
+		return err
+	}
+	return nil
+}
+
+// 有効期限を延長するためにCookieを保存し直すか判断する
+// Cookieを毎回書き直さないよう、最後の保存から IdleTimeout の半分が過ぎ、
+// 最長有効期間の範囲で延長できる場合のみ保存し直す
+func needsRefresh(sessionStore Store, now time.Time) bool {
+	return sessionStore.Expire.Sub(now) <= setting.Session.IdleTimeout/2 &&
+		nextExpire(sessionStore.Created, now).After(sessionStore.Expire)
+}
+
+// IDを復号し、ログインしているユーザーのセッションの世代が有効か確認する
+// （ユーザーの現在の世代を合わせて返す）
+func (m *CookieManager) openCurrent(sessionID ID) (cookieRecord, int64, error) {
+	record, err := m.open(sessionID)
+	if err != nil {
+		return record, 0, err
+	}
+	generation, keep, err := m.generation(record.Data[UserIDKey])
+	if err != nil {
+		return record, 0, err
+	}
+	// 世代を進めた際に引き継いだセッションは、1つ前の世代でも有効とする
+	if record.Generation != generation &&
+		!(keep != "" && record.Generation == generation-1 && record.SID == keep) {
+		return record, 0, ErrorNotFound
+	}
+	return record, generation, nil
+}
+
+// ユーザーの現在のセッションの世代を返す（ログインしていない場合や Generations が無い場合は0）
+func (m *CookieManager) generation(userID string) (int64, string, error) {
+	if userID == "" || m.generations == nil {
+		return 0, "", nil
+	}
+	return m.generations.SessionGeneration(userID)
+}
+
+// セッションを暗号化してIDにする
+func (m *CookieManager) seal(record cookieRecord) (ID, error) {
+	plain, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	key := m.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// バージョン | 鍵ID | ノンス | 暗号文
+	sealed := []byte{cookieVersion}
+	sealed = append(sealed, key.id...)
+	sealed = append(sealed, nonce...)
+	sealed = key.aead.Seal(sealed, nonce, plain, cookieAdditionalData)
+	encoded := base64.RawURLEncoding.EncodeToString(sealed)
+	if len(encoded) > cookieMaxLength {
+		return "", ErrorTooLarge
+	}
+	return ID(encoded), nil
+}
+
+// IDを復号してセッションに戻す（改ざん・期限切れの場合は ErrorNotFound を返す）
+func (m *CookieManager) open(sessionID ID) (cookieRecord, error) {
+	var record cookieRecord
+	sealed, err := base64.RawURLEncoding.DecodeString(string(sessionID))
+	if err != nil || len(sealed) < 1+cookieKeyIDLen || sealed[0] != cookieVersion {
+		return record, ErrorNotFound
+	}
+	keyID := sealed[1 : 1+cookieKeyIDLen]
+	for _, key := range m.keys {
+		if !bytes.Equal(key.id, keyID) {
+			continue
+		}
+		body := sealed[1+cookieKeyIDLen:]
+		if len(body) < key.aead.NonceSize() {
+			return record, ErrorNotFound
+		}
+		nonce, ciphertext := body[:key.aead.NonceSize()], body[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, cookieAdditionalData)
+		if err != nil {
+			return record, ErrorNotFound
+		}
+		if err := json.Unmarshal(plain, &record); err != nil {
+			return record, ErrorNotFound
+		}
+		if time.Now().After(time.Unix(record.Expire, 0)) {
+			return record, ErrorNotFound
+		}
+		return record, nil
+	}
+	return record, ErrorNotFound
+}
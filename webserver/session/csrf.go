@@ -0,0 +1,44 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// CSRFトークンを保存するデータストアのキー
+const csrfKey = "csrf_token"
+
+// CSRFトークンの長さ（バイト）
+const csrfTokenLength = 32
+
+// CSRFToken は セッションのCSRFトークンを返します。
+// トークンが無い場合は新しく生成してデータストアに設定します。
+// ログイン前で有効なセッションが無い場合は、保存時に匿名のセッションを作成します。
+func (r *Request) CSRFToken() (string, error) {
+	if token, ok := r.Value(csrfKey); ok {
+		return token, nil
+	}
+	return r.RotateCSRFToken()
+}
+
+// RotateCSRFToken は 新しいCSRFトークンを生成してデータストアに設定します。
+// ログインなどで認証状態が変わる際に呼び出し、それまでのトークンは無効にします。
+func (r *Request) RotateCSRFToken() (string, error) {
+	b := make([]byte, csrfTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	r.SetValue(csrfKey, token)
+	return token, nil
+}
+
+// VerifyCSRFToken は token がセッションのCSRFトークンと一致するかを返します。
+func (r *Request) VerifyCSRFToken(token string) bool {
+	expected, ok := r.Value(csrfKey)
+	if !ok || expected == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
@@ -0,0 +1,52 @@
+package session
+
+// フラッシュメッセージのレベル
+const (
+	FlashInfo  = "info"  // お知らせ
+	FlashWarn  = "warn"  // 警告
+	FlashError = "error" // エラー
+)
+
+// フラッシュメッセージを保存するデータストアのキー
+const flashKey = "_flash"
+
+// 保存しておけるフラッシュメッセージの大きさの上限（変換後のバイト数）
+const flashMaxSize = 2048
+
+func init() {
+	RegisterKey(flashKey, JSONCodec, flashMaxSize)
+}
+
+// Flash は 次に表示する画面で一度だけ表示するメッセージです。
+// リダイレクトの前に AddFlash で保存し、リダイレクト先の画面で Flashes で取り出します。
+type Flash struct {
+	Level   string
+	Message string
+}
+
+// AddFlash は フラッシュメッセージを追加します。
+// 保存できる大きさの上限を超える場合は ErrorTooLarge を返します。
+func (r *Request) AddFlash(level string, message string) error {
+	var flashes []Flash
+	if err := r.Get(flashKey, &flashes); err != nil && err != ErrorNotFound {
+		return err
+	}
+	flashes = append(flashes, Flash{Level: level, Message: message})
+	return r.Set(flashKey, flashes)
+}
+
+// Flashes は 保存されているフラッシュメッセージを取り出します。
+// 取り出したメッセージはセッションから削除します。
+func (r *Request) Flashes() []Flash {
+	var flashes []Flash
+	err := r.Get(flashKey, &flashes)
+	if err == ErrorNotFound {
+		return nil
+	}
+	// 読み出せない値が残らないよう、変換に失敗した場合も削除する
+	r.DeleteValue(flashKey)
+	if err != nil {
+		return nil
+	}
+	return flashes
+}
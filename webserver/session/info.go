@@ -0,0 +1,64 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// UserIDKey は ログインしているユーザーのIDを保存するデータストアのキーです。
+// Manager はこのキーの値でセッションをユーザー毎に管理します。
+const UserIDKey = "user_id"
+
+// AuthStateKey は ログインの認証状態を保存するデータストアのキーです。
+const AuthStateKey = "auth_state"
+
+// AuthStateAuthenticated は ログインが完了したセッションの認証状態です。
+// 同時にログインできるセッション数の上限は、この状態のセッションのみを数えます。
+const AuthStateAuthenticated = "authenticated"
+
+// 一覧の Info.Data にコピーするデータストアのキー
+// （CSRFトークンなど、画面に表示してはいけない値は含めない）
+var infoKeys = []string{UserIDKey, AuthStateKey}
+
+// Info は セッションの一覧に表示するための情報です。
+// セッションIDそのものは含まず、代わりにセッションIDから求めた Key を使用します。
+// Data はデータストアのうち一覧に表示するキー（user_id・auth_state）のコピーで、
+// 変更してもセッションには反映されません。
+type Info struct {
+	Key        string
+	UserID     string
+	Data       map[string]string
+	Created    time.Time
+	LastAccess time.Time
+	Expire     time.Time
+	IP         string
+	UserAgent  string
+}
+
+// KeyOf は セッションIDから一覧の操作に使用するKeyを求めます。
+// 画面にセッションIDを出力しないよう、ハッシュ化した値を使用します。
+func KeyOf(sessionID ID) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// セッションの一覧用の情報を作成する
+func newInfo(id ID, x session) Info {
+	data := make(map[string]string)
+	for _, k := range infoKeys {
+		if v, ok := x.store.Data[k]; ok {
+			data[k] = v
+		}
+	}
+	return Info{
+		Key:        KeyOf(id),
+		UserID:     x.store.Data[UserIDKey],
+		Data:       data,
+		Created:    x.created,
+		LastAccess: x.lastAccess,
+		Expire:     x.expire,
+		IP:         x.ip,
+		UserAgent:  x.userAgent,
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"../setting"
 	"github.com/labstack/echo"
 )
 
@@ -11,9 +12,64 @@ import (
 type ID string
 
 // Store はセッションデータと整合性トークンを保持する構造体です。
+// Created・Expire は読み出した時点のセッションの作成日時・有効期限で、
+// 保存の際には無視されます。
 type Store struct {
 	Data             map[string]string
 	ConsistencyToken string
+	Created          time.Time
+	Expire           time.Time
+}
+
+// ExpiresWithin は セッションの有効期限が指定した時間以内か確認します。
+func (s Store) ExpiresWithin(d time.Duration) bool {
+	return time.Until(s.Expire) <= d
+}
+
+// Provider は セッションの操作を行うAPIです。
+// サーバー側にセッションを保存する Manager と、Cookieにセッションを保存する
+// CookieManager があり、setting.Session.Storage で切り替えます。
+type Provider interface {
+	Start(echo *echo.Echo) error
+	Stop()
+	Create() (ID, error)
+	LoadStore(sessionID ID) (Store, error)
+	Delete(sessionID ID) error
+	Regenerate(sessionID ID) (ID, error)
+	SetClient(sessionID ID, ip string, userAgent string) error
+	ListByUser(userID string) ([]Info, error)
+	DeleteByUser(userID string) error
+	DeleteAllExceptCurrent(userID string, currentID ID) error
+	DeleteByKey(userID string, key string) error
+	List(query ListQuery) (ListResult, error)
+}
+
+// Saver は サーバー側にセッションを保存する Provider が実装します。
+// セッションIDを変えずにデータストアを保存・変更します。
+type Saver interface {
+	SaveStore(sessionID ID, sessionStore Store) error
+	Update(sessionID ID, fn func(sessionStore *Store) error) error
+}
+
+// Authenticator は ユーザー毎のセッションの一覧を持つ Provider が実装します。
+// 同時にログインできるセッション数の上限の確認とログインの完了を、
+// 他のログインと競合しないようにまとめて行います。
+type Authenticator interface {
+	Authenticate(sessionID ID, userID string, limit int, evict bool) ([]Info, error)
+}
+
+// Resealer は セッションの内容をIDそのものに保存する Provider が実装します。
+// 保存する度にIDが変わるため、SaveStore の代わりに Reseal を使用します。
+type Resealer interface {
+	Reseal(sessionID ID, sessionStore Store) (ID, error)
+}
+
+// NewProvider は 設定に応じた Provider を生成します。
+func NewProvider() Provider {
+	if setting.Session.Storage == StorageCookie {
+		return &CookieManager{}
+	}
+	return &Manager{}
 }
 
 // Manager は Sessionの操作・管理を行います。
@@ -21,20 +77,41 @@ type Manager struct {
 	stopCh    chan struct{}
 	commandCh chan command
 	stopGCCh  chan struct{}
+	storage   storage
+	gcEnabled bool
 }
 
 // Start は Managerの開始を行います。
-func (m *Manager) Start(echo *echo.Echo) {
-	e = echo
+// セッションの保存先は setting.Session.Storage で指定します。
+func (m *Manager) Start(echo *echo.Echo) error {
+	setEcho(echo)
+	storage, err := newStorage()
+	if err != nil {
+		return err
+	}
+	if err := storage.Open(); err != nil {
+		return err
+	}
+	m.storage = storage
+	// メインループの開始前にチャネルを作成し、直後の呼び出しでも待たされないようにする
+	m.stopCh = make(chan struct{}, 1)
+	m.commandCh = make(chan command, 1)
 	go m.mainLoop()
-	time.Sleep(100 * time.Millisecond)
-	go m.gcLoop()
+	// 期限切れのセッションをストレージ自身が削除する場合はGCを行わない
+	m.gcEnabled = !storage.ExpiresNatively()
+	if m.gcEnabled {
+		m.stopGCCh = make(chan struct{}, 1)
+		go m.gcLoop()
+	}
+	return nil
 }
 
 // Stop は Managerの停止を行います。
 func (m *Manager) Stop() {
-	m.stopGCCh <- struct{}{}
-	time.Sleep(100 * time.Millisecond)
+	if m.gcEnabled {
+		m.stopGCCh <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+	}
 	m.stopCh <- struct{}{}
 }
 
@@ -107,11 +184,182 @@ func (m *Manager) Delete(sessionID ID) error {
 	return nil
 }
 
+// Update が整合性トークンの競合時に再試行する回数
+const updateMaxRetries = 3
+
+// Update は データストアを読み出して fn で変更し、保存します。
+// 他のリクエストとの保存の競合（ErrorInvalidToken）が起きた場合は、
+// updateMaxRetries 回まで読み出しからやり直します。
+// fn は再試行の度に最新のデータストアで呼び出されるため、データストア以外の
+// 変更を行わないようにしてください。fn がエラーを返した場合は保存しません。
+func (m *Manager) Update(sessionID ID, fn func(sessionStore *Store) error) error {
+	var err error
+	for i := 0; i <= updateMaxRetries; i++ {
+		var sessionStore Store
+		sessionStore, err = m.LoadStore(sessionID)
+		if err != nil {
+			return err
+		}
+		if err = fn(&sessionStore); err != nil {
+			return err
+		}
+		err = m.SaveStore(sessionID, sessionStore)
+		if err != ErrorInvalidToken {
+			return err
+		}
+		e.Logger.Debugf("Session[%s] Update conflict. retry[%d]", sessionID, i+1)
+	}
+	return err
+}
+
+// Regenerate は セッションIDの再発行を行います。
+// データストアを新しいIDのセッションに移し、元のIDのセッションは削除します。
+// ログインや権限の変更の際に呼び出し、セッション固定攻撃を防ぎます。
+func (m *Manager) Regenerate(sessionID ID) (ID, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{sessionID}
+	cmd := command{commandRegenerate, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	var res ID
+	if resp.err != nil {
+		e.Logger.Debugf("Session[%s] Regenerate Error. [%s]", sessionID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(ID); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("Session[%s] Regenerate Error. [%s]", sessionID, ErrorOther)
+	return res, ErrorOther
+}
+
+// SetClient は セッションの一覧に表示する接続元の情報を記録します。
+func (m *Manager) SetClient(sessionID ID, ip string, userAgent string) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{sessionID, ip, userAgent}
+	cmd := command{commandSetClient, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("Session[%s] SetClient Error. [%s]", sessionID, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// ListByUser は ユーザーのセッションの一覧を、最後にアクセスした日時の新しい順に返します。
+// ユーザーは データストアの UserIDKey の値で判断します。
+func (m *Manager) ListByUser(userID string) ([]Info, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{userID}
+	cmd := command{commandListByUser, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	var res []Info
+	if resp.err != nil {
+		e.Logger.Debugf("User[%s] Session List Error. [%s]", userID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].([]Info); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[%s] Session List Error. [%s]", userID, ErrorOther)
+	return res, ErrorOther
+}
+
+// DeleteByUser は ユーザーのセッションを全て削除します。
+func (m *Manager) DeleteByUser(userID string) error {
+	return m.deleteByUser(userID, "")
+}
+
+// DeleteAllExceptCurrent は 現在のセッション以外のユーザーのセッションを全て削除します。
+func (m *Manager) DeleteAllExceptCurrent(userID string, currentID ID) error {
+	return m.deleteByUser(userID, currentID)
+}
+
+func (m *Manager) deleteByUser(userID string, exceptID ID) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{userID, exceptID}
+	cmd := command{commandDeleteByUser, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("User[%s] Session Delete Error. [%s]", userID, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// Authenticate は セッションをユーザーのログインが完了した状態にします。
+// limit が0より大きい場合は、ログインが完了している他のセッションの数を確認し、
+// 上限に達している場合は、evict なら作成日時の古いセッションから終了させ、
+// そうでなければ ErrorLimitExceeded を返します。終了させたセッションの一覧を返します。
+func (m *Manager) Authenticate(sessionID ID, userID string, limit int, evict bool) ([]Info, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{sessionID, userID, limit, evict}
+	cmd := command{commandAuthenticate, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	var res []Info
+	if resp.err != nil {
+		e.Logger.Debugf("Session[%s] Authenticate Error. user[%s] [%s]", sessionID, userID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].([]Info); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("Session[%s] Authenticate Error. user[%s] [%s]", sessionID, userID, ErrorOther)
+	return res, ErrorOther
+}
+
+// DeleteByKey は ユーザーのセッションのうち、Keyが一致するセッションを削除します。
+// Keyは ListByUser・List が返す Info.Key です。
+// userIDが空の場合は、ログインしていないセッションを含む全てのセッションから探します。
+func (m *Manager) DeleteByKey(userID string, key string) error {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{userID, key}
+	cmd := command{commandDeleteByKey, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	if resp.err != nil {
+		e.Logger.Debugf("User[%s] Session[Key=%s] Delete Error. [%s]", userID, key, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// List は 条件に一致する有効期限内のセッションの一覧を返します。
+// LoadStore と同様に、データストアはコピーを返します。
+func (m *Manager) List(query ListQuery) (ListResult, error) {
+	respCh := make(chan response, 1)
+	defer close(respCh)
+	req := []interface{}{query}
+	cmd := command{commandList, req, respCh}
+	m.commandCh <- cmd
+	resp := <-respCh
+	var res ListResult
+	if resp.err != nil {
+		e.Logger.Debugf("Session List Error. query[%v] [%s]", query, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(ListResult); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("Session List Error. query[%v] [%s]", query, ErrorOther)
+	return res, ErrorOther
+}
+
 // DeleteExpired は 期限切れセッションの削除を行います。
 func (m *Manager) DeleteExpired() error {
 	respCh := make(chan response, 1)
 	defer close(respCh)
-	cmd := command{commandDelete, nil, respCh}
+	cmd := command{commandDeleteExpired, nil, respCh}
 	m.commandCh <- cmd
 	resp := <-respCh
 	if resp.err != nil {
@@ -128,5 +376,8 @@ var (
 	ErrorInvalidToken   = errors.New("Invalid Token")
 	ErrorInvalidCommand = errors.New("Invalid Command")
 	ErrorNotImplemented = errors.New("Not Implemented")
+	ErrorTooLarge       = errors.New("Too Large")
+	ErrorNotRegistered  = errors.New("Not Registered")
+	ErrorLimitExceeded  = errors.New("Limit Exceeded")
 	ErrorOther          = errors.New("Other")
 )
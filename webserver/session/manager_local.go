@@ -1,24 +1,39 @@
 package session
 
 import (
+	"sort"
+	"sync"
 	"time"
 
+	"../setting"
 	"github.com/labstack/echo"
 	uuid "github.com/satori/go.uuid"
 )
 
 // echoのインスタンス
-var e *echo.Echo
+var (
+	e     *echo.Echo
+	eOnce sync.Once
+)
+
+// ログの出力に使用するechoのインスタンスを設定する
+// （動作中の他の Manager と競合しないよう、最初に開始した際の1回のみ設定する）
+func setEcho(echo *echo.Echo) {
+	eOnce.Do(func() {
+		e = echo
+	})
+}
 
 // セッション毎の情報
 type session struct {
-	store  Store
-	expire time.Time
+	store      Store
+	created    time.Time
+	expire     time.Time
+	lastAccess time.Time
+	ip         string
+	userAgent  string
 }
 
-// セッションの有効期限
-const sessionExpire time.Duration = (3 * time.Minute)
-
 // コマンド種別の定義
 type commandType int
 
@@ -28,6 +43,13 @@ const (
 	commandSaveStore                        // データストアの保存
 	commandDelete                           // セッションの削除
 	commandDeleteExpired                    // 期限切れのセッションを削除
+	commandRegenerate                       // セッションIDの再発行
+	commandSetClient                        // 接続元の情報の記録
+	commandListByUser                       // ユーザーのセッションの一覧
+	commandDeleteByUser                     // ユーザーのセッションを削除
+	commandDeleteByKey                      // Keyを指定してユーザーのセッションを削除
+	commandList                             // 条件を指定してセッションの一覧を取得
+	commandAuthenticate                     // セッション数の上限を確認してログインを完了
 )
 
 // コマンド実行のためのパラメータ
@@ -45,9 +67,6 @@ type response struct {
 
 // Manager のメインループ処理
 func (m *Manager) mainLoop() {
-	sessions := make(map[ID]session)
-	m.stopCh = make(chan struct{}, 1)
-	m.commandCh = make(chan command, 1)
 	defer close(m.commandCh)
 	defer close(m.stopCh)
 	e.Logger.Info("session.Manager:start")
@@ -66,8 +85,16 @@ loop:
 				sessionStore.Data = sessionData
 				sessionStore.ConsistencyToken = createToken()
 				session.store = sessionStore
-				session.expire = time.Now().Add(sessionExpire)
-				sessions[sessionID] = session
+				session.created = time.Now()
+				session.lastAccess = session.created
+				session.expire = nextExpire(session.created, session.created)
+				err := m.storage.Transaction(func(tx storageTx) error {
+					return tx.Put(sessionID, session)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
 				res := []interface{}{sessionID}
 				e.Logger.Debugf("Session[%s] Create. expire[%s]", sessionID, session.expire)
 				cmd.responseCh <- response{res, nil}
@@ -78,13 +105,19 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				session, ok := sessions[reqSessionID]
-				if !ok {
-					cmd.responseCh <- response{nil, ErrorNotFound}
-					break
-				}
-				if time.Now().After(session.expire) {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+				var session session
+				err := m.storage.Transaction(func(tx storageTx) error {
+					var err error
+					session, err = getSession(tx, reqSessionID)
+					if err != nil {
+						return err
+					}
+					session.lastAccess = time.Now()
+					session.expire = nextExpire(session.created, session.lastAccess)
+					return tx.Put(reqSessionID, session)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
 				sessionStore := Store{}
@@ -94,9 +127,9 @@ loop:
 				}
 				sessionStore.Data = sessionData
 				sessionStore.ConsistencyToken = session.store.ConsistencyToken
-				session.expire = time.Now().Add(sessionExpire)
-				sessions[reqSessionID] = session
-				e.Logger.Debugf("Session[%s] Load store. store[%s] expire[%s]", reqSessionID, session.store, session.expire)
+				sessionStore.Created = session.created
+				sessionStore.Expire = session.expire
+				e.Logger.Debugf("Session[%s] Load store. keys%s expire[%s]", reqSessionID, storeKeys(session.store), session.expire)
 				res := []interface{}{sessionStore}
 				cmd.responseCh <- response{res, nil}
 			// データストアの保存
@@ -111,30 +144,33 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				session, ok := sessions[reqSessionID]
-				if !ok {
-					cmd.responseCh <- response{nil, ErrorNotFound}
-					break
-				}
-				if time.Now().After(session.expire) {
-					cmd.responseCh <- response{nil, ErrorNotFound}
-					break
-				}
-				if session.store.ConsistencyToken != reqSessionStore.ConsistencyToken {
-					cmd.responseCh <- response{nil, ErrorInvalidToken}
+				var session session
+				err := m.storage.Transaction(func(tx storageTx) error {
+					var err error
+					session, err = getSession(tx, reqSessionID)
+					if err != nil {
+						return err
+					}
+					if session.store.ConsistencyToken != reqSessionStore.ConsistencyToken {
+						return ErrorInvalidToken
+					}
+					sessionStore := Store{}
+					sessionData := make(map[string]string)
+					for k, v := range reqSessionStore.Data {
+						sessionData[k] = v
+					}
+					sessionStore.Data = sessionData
+					sessionStore.ConsistencyToken = createToken()
+					session.store = sessionStore
+					session.lastAccess = time.Now()
+					session.expire = nextExpire(session.created, session.lastAccess)
+					return tx.Put(reqSessionID, session)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				sessionStore := Store{}
-				sessionData := make(map[string]string)
-				for k, v := range reqSessionStore.Data {
-					sessionData[k] = v
-				}
-				sessionStore.Data = sessionData
-				sessionStore.ConsistencyToken = createToken()
-				session.store = sessionStore
-				session.expire = time.Now().Add(sessionExpire)
-				sessions[reqSessionID] = session
-				e.Logger.Debugf("Session[%s] Save store. store[%s] expire[%s]", reqSessionID, session.store, session.expire)
+				e.Logger.Debugf("Session[%s] Save store. keys%s expire[%s]", reqSessionID, storeKeys(session.store), session.expire)
 				cmd.responseCh <- response{nil, nil}
 			// セッションの削除
 			case commandDelete:
@@ -143,28 +179,217 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				session, ok := sessions[reqSessionID]
+				err := m.storage.Transaction(func(tx storageTx) error {
+					if _, err := getSession(tx, reqSessionID); err != nil {
+						return err
+					}
+					return tx.Delete(reqSessionID)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				e.Logger.Debugf("Session[%s] Delete.", reqSessionID)
+				cmd.responseCh <- response{nil, nil}
+			// セッションIDの再発行
+			case commandRegenerate:
+				reqSessionID, ok := cmd.req[0].(ID)
 				if !ok {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				if time.Now().After(session.expire) {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+				newSessionID := ID(createSessionID())
+				var session session
+				err := m.storage.Transaction(func(tx storageTx) error {
+					var err error
+					session, err = getSession(tx, reqSessionID)
+					if err != nil {
+						return err
+					}
+					session.store.ConsistencyToken = createToken()
+					// 最長有効期間は元のセッションの作成日時から数える
+					session.expire = nextExpire(session.created, time.Now())
+					if err := tx.Put(newSessionID, session); err != nil {
+						return err
+					}
+					return tx.Delete(reqSessionID)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				delete(sessions, reqSessionID)
-				e.Logger.Debugf("Session[%s] Delete.", reqSessionID)
-				cmd.responseCh <- response{nil, nil}
+				e.Logger.Debugf("Session[%s] Regenerate. new[%s] expire[%s]", reqSessionID, newSessionID, session.expire)
+				res := []interface{}{newSessionID}
+				cmd.responseCh <- response{res, nil}
 			// 期限切れのセッションを削除
 			case commandDeleteExpired:
 				e.Logger.Debugf("Run Session GC. Now[%s]", time.Now())
-				for k, v := range sessions {
-					if time.Now().After(v.expire) {
-						e.Logger.Debugf("Session[%s] expire delete. expire[%s]", k, v.expire)
-						delete(sessions, k)
+				err := m.storage.DeleteExpired(time.Now())
+				cmd.responseCh <- response{nil, err}
+			// 接続元の情報の記録
+			case commandSetClient:
+				reqSessionID, ok1 := cmd.req[0].(ID)
+				reqIP, ok2 := cmd.req[1].(string)
+				reqUserAgent, ok3 := cmd.req[2].(string)
+				if !ok1 || !ok2 || !ok3 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				err := m.storage.Transaction(func(tx storageTx) error {
+					session, err := getSession(tx, reqSessionID)
+					if err != nil {
+						return err
+					}
+					session.ip = reqIP
+					session.userAgent = reqUserAgent
+					return tx.Put(reqSessionID, session)
+				})
+				cmd.responseCh <- response{nil, err}
+			// ユーザーのセッションの一覧
+			case commandListByUser:
+				reqUserID, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				var results []Info
+				err := m.storage.Transaction(func(tx storageTx) error {
+					sessions, err := userSessions(tx, reqUserID)
+					if err != nil {
+						return err
+					}
+					results = []Info{}
+					for id, session := range sessions {
+						results = append(results, newInfo(id, session))
+					}
+					return nil
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				sortInfos(results)
+				res := []interface{}{results}
+				cmd.responseCh <- response{res, nil}
+			// ユーザーのセッションを削除
+			case commandDeleteByUser:
+				reqUserID, ok1 := cmd.req[0].(string)
+				reqExceptID, ok2 := cmd.req[1].(ID)
+				if !ok1 || !ok2 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				var deleted []ID
+				err := m.storage.Transaction(func(tx storageTx) error {
+					sessions, err := userSessions(tx, reqUserID)
+					if err != nil {
+						return err
+					}
+					deleted = []ID{}
+					for id := range sessions {
+						if id == reqExceptID {
+							continue
+						}
+						if err := tx.Delete(id); err != nil {
+							return err
+						}
+						deleted = append(deleted, id)
+					}
+					return nil
+				})
+				if err == nil {
+					for _, id := range deleted {
+						e.Logger.Debugf("Session[%s] Delete. user[%s]", id, reqUserID)
+					}
+				}
+				cmd.responseCh <- response{nil, err}
+			// Keyを指定してユーザーのセッションを削除
+			case commandDeleteByKey:
+				reqUserID, ok1 := cmd.req[0].(string)
+				reqKey, ok2 := cmd.req[1].(string)
+				if !ok1 || !ok2 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				var id ID
+				err := m.storage.Transaction(func(tx storageTx) error {
+					var err error
+					id, err = m.findByKey(tx, reqUserID, reqKey)
+					if err != nil {
+						return err
 					}
+					return tx.Delete(id)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
 				}
+				e.Logger.Debugf("Session[%s] Delete. user[%s]", id, reqUserID)
 				cmd.responseCh <- response{nil, nil}
+			// 条件を指定してセッションの一覧を取得
+			case commandList:
+				reqQuery, ok := cmd.req[0].(ListQuery)
+				if !ok || reqQuery.Offset < 0 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				now := time.Now()
+				matches := []Info{}
+				err := m.storage.ForEach(func(id ID, x session) error {
+					if now.After(x.expire) || !reqQuery.match(&x) {
+						return nil
+					}
+					// データストアはコピーして返す
+					matches = append(matches, newInfo(id, x))
+					return nil
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				sortInfos(matches)
+				res := []interface{}{ListResult{reqQuery.page(matches), len(matches)}}
+				cmd.responseCh <- response{res, nil}
+			// セッション数の上限を確認してログインを完了
+			case commandAuthenticate:
+				reqSessionID, ok1 := cmd.req[0].(ID)
+				reqUserID, ok2 := cmd.req[1].(string)
+				reqLimit, ok3 := cmd.req[2].(int)
+				reqEvict, ok4 := cmd.req[3].(bool)
+				if !ok1 || !ok2 || !ok3 || !ok4 || reqUserID == "" {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				var evicted []Info
+				err := m.storage.Transaction(func(tx storageTx) error {
+					session, err := getSession(tx, reqSessionID)
+					if err != nil {
+						return err
+					}
+					evicted, err = evictOverLimit(tx, reqSessionID, reqUserID, reqLimit, reqEvict)
+					if err != nil {
+						return err
+					}
+					if session.store.Data == nil {
+						session.store.Data = make(map[string]string)
+					}
+					session.store.Data[UserIDKey] = reqUserID
+					session.store.Data[AuthStateKey] = AuthStateAuthenticated
+					session.store.ConsistencyToken = createToken()
+					session.lastAccess = time.Now()
+					session.expire = nextExpire(session.created, session.lastAccess)
+					return tx.Put(reqSessionID, session)
+				})
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				for _, x := range evicted {
+					e.Logger.Debugf("Session[Key=%s] Evict. user[%s]", x.Key, reqUserID)
+				}
+				e.Logger.Debugf("Session[%s] Authenticate. user[%s] evicted[%d]", reqSessionID, reqUserID, len(evicted))
+				res := []interface{}{evicted}
+				cmd.responseCh <- response{res, nil}
 			// それ以外（エラー）
 			default:
 				cmd.responseCh <- response{nil, ErrorInvalidCommand}
@@ -173,12 +398,143 @@ loop:
 			break loop
 		}
 	}
+	if err := m.storage.Close(); err != nil {
+		e.Logger.Debugf("Session Storage Close Error. [%s]", err)
+	}
 	e.Logger.Info("session.Manager:stop")
 }
 
+// 有効期限内のセッションをストレージから読み出す
+func getSession(tx storageTx, sessionID ID) (session, error) {
+	session, ok, err := tx.Get(sessionID)
+	if err != nil {
+		return session, err
+	}
+	if !ok {
+		return session, ErrorNotFound
+	}
+	if time.Now().After(session.expire) {
+		return session, ErrorNotFound
+	}
+	return session, nil
+}
+
+// ユーザーの有効期限内のセッションを読み出す
+// 一覧に残っている期限切れ・削除済みのセッションは、一覧からも取り除く
+func userSessions(tx storageTx, userID string) (map[ID]session, error) {
+	ids, err := tx.UserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make(map[ID]session)
+	for _, id := range ids {
+		session, err := getSession(tx, id)
+		if err == ErrorNotFound {
+			if err := tx.Delete(id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 他のユーザーのセッションになっている場合は含めない
+		if session.store.Data[UserIDKey] != userID {
+			continue
+		}
+		sessions[id] = session
+	}
+	return sessions, nil
+}
+
+// ログインが完了しているユーザーの他のセッションが上限に達している場合は、
+// evict なら作成日時の古いセッションから削除し、そうでなければ ErrorLimitExceeded を返す
+// （limitが0以下の場合は無制限）
+func evictOverLimit(tx storageTx, sessionID ID, userID string, limit int, evict bool) ([]Info, error) {
+	evicted := []Info{}
+	if limit <= 0 {
+		return evicted, nil
+	}
+	sessions, err := userSessions(tx, userID)
+	if err != nil {
+		return evicted, err
+	}
+	others := []Info{}
+	evictIDs := make(map[string]ID)
+	for id, session := range sessions {
+		if id == sessionID || session.store.Data[AuthStateKey] != AuthStateAuthenticated {
+			continue
+		}
+		info := newInfo(id, session)
+		others = append(others, info)
+		evictIDs[info.Key] = id
+	}
+	if len(others) < limit {
+		return evicted, nil
+	}
+	if !evict {
+		return evicted, ErrorLimitExceeded
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].Created.Before(others[j].Created)
+	})
+	for _, x := range others[:len(others)-limit+1] {
+		if err := tx.Delete(evictIDs[x.Key]); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, x)
+	}
+	return evicted, nil
+}
+
+// Keyが一致するセッションのIDを探す（見つからない場合は ErrorNotFound を返す）
+// userIDが空の場合は、ログインしていないセッションを含む全てのセッションから探す
+func (m *Manager) findByKey(tx storageTx, userID string, key string) (ID, error) {
+	if userID != "" {
+		sessions, err := userSessions(tx, userID)
+		if err != nil {
+			return "", err
+		}
+		for id := range sessions {
+			if KeyOf(id) == key {
+				return id, nil
+			}
+		}
+		return "", ErrorNotFound
+	}
+	var found ID
+	err := m.storage.ForEach(func(id ID, x session) error {
+		if found == "" && KeyOf(id) == key {
+			found = id
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", ErrorNotFound
+	}
+	// 見つけたセッションを監視の対象にする
+	if _, err := getSession(tx, found); err != nil {
+		return "", err
+	}
+	return found, nil
+}
+
+// 次の有効期限を求める
+// 最後のアクセスから IdleTimeout、作成から AbsoluteTimeout のうち早い方になります。
+func nextExpire(created time.Time, now time.Time) time.Time {
+	expire := now.Add(setting.Session.IdleTimeout)
+	limit := created.Add(setting.Session.AbsoluteTimeout)
+	if limit.Before(expire) {
+		return limit
+	}
+	return expire
+}
+
 // 期限切れセッションの定期削除処理
 func (m *Manager) gcLoop() {
-	m.stopGCCh = make(chan struct{}, 1)
 	defer close(m.stopGCCh)
 	e.Logger.Info("session.Manager GC:start")
 	t := time.NewTicker(1 * time.Minute)
@@ -208,3 +564,14 @@ func createSessionID() string {
 func createToken() string {
 	return uuid.NewV4().String()
 }
+
+// ログに出力するデータストアのキーの一覧
+// （CSRFトークンなどの値がログに残らないよう、値は出力しない）
+func storeKeys(sessionStore Store) []string {
+	keys := make([]string, 0, len(sessionStore.Data))
+	for k := range sessionStore.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
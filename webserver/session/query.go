@@ -0,0 +1,57 @@
+package session
+
+import (
+	"sort"
+	"strings"
+)
+
+// ListQuery はセッション一覧の検索条件です。
+type ListQuery struct {
+	UserID       string // ユーザーIDの部分一致（大文字・小文字は区別しない）
+	IP           string // 接続元IPアドレスの前方一致
+	LoggedInOnly bool   // trueの場合はユーザーIDを持つセッションのみを返す
+	Offset       int    // 先頭から読み飛ばす件数
+	Limit        int    // 返す最大件数（0以下の場合は全件）
+}
+
+// ListResult はセッション一覧の検索結果です。
+type ListResult struct {
+	Sessions []Info // Offset / Limit を適用した結果（最後にアクセスした日時の新しい順）
+	Total    int    // Offset / Limit を適用する前の件数
+}
+
+// セッションが検索条件に一致するか確認する
+func (q *ListQuery) match(x *session) bool {
+	userID := x.store.Data[UserIDKey]
+	if q.LoggedInOnly && userID == "" {
+		return false
+	}
+	if q.UserID != "" && !strings.Contains(strings.ToLower(userID), strings.ToLower(q.UserID)) {
+		return false
+	}
+	if q.IP != "" && !strings.HasPrefix(x.ip, q.IP) {
+		return false
+	}
+	return true
+}
+
+// 検索結果を最後にアクセスした日時の新しい順に並び替える
+func sortInfos(infos []Info) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastAccess.After(infos[j].LastAccess)
+	})
+}
+
+// Offset / Limit を適用する
+func (q *ListQuery) page(infos []Info) []Info {
+	if q.Offset >= len(infos) {
+		return []Info{}
+	}
+	if q.Offset > 0 {
+		infos = infos[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(infos) {
+		infos = infos[:q.Limit]
+	}
+	return infos
+}
@@ -0,0 +1,320 @@
+package session
+
+import (
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// echo.Context にリクエストのセッションを保存するキー
+const contextKey = "session"
+
+// Request は 1つのリクエストの間に使用するセッションです。
+// 最初に参照した時に一度だけ読み出し、変更は Save を呼び出すか、
+// レスポンスの送信前に Middleware がまとめて保存します。
+// 変更していない場合は保存しません。
+type Request struct {
+	c        echo.Context
+	provider Provider
+	loaded   bool
+	valid    bool
+	id       ID
+	store    Store
+	cleared  bool
+	changed  map[string]struct{}
+}
+
+// Middleware は リクエストのセッションを echo.Context に保存する Middleware を返します。
+// 変更されたセッションは、ハンドラがレスポンスを書き込まずに終了した場合は
+// その時点で保存してエラーを返し、書き込む場合はレスポンスの送信前に保存します。
+// 送信前の保存はエラーを返せないため、保存の失敗を扱う必要がある場合は
+// ハンドラの中で Save を呼び出してください。
+// ハンドラでは FromContext でセッションを取得します。
+func Middleware(p Provider) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := &Request{
+				c:        c,
+				provider: p,
+				changed:  make(map[string]struct{}),
+			}
+			c.Set(contextKey, r)
+			c.Response().Before(func() {
+				if err := r.Save(); err != nil {
+					c.Echo().Logger.Errorf("Session Save Error. [%s]", err)
+				}
+			})
+			if err := next(c); err != nil {
+				return err
+			}
+			if !c.Response().Committed {
+				return r.Save()
+			}
+			return nil
+		}
+	}
+}
+
+// FromContext は Middleware が保存したリクエストのセッションを返します。
+// Middleware を適用していない場合は nil を返します。
+func FromContext(c echo.Context) *Request {
+	r, _ := c.Get(contextKey).(*Request)
+	return r
+}
+
+// Cookieのセッションを読み出す（リクエスト中に一度だけ）
+func (r *Request) load() {
+	if r.loaded {
+		return
+	}
+	r.loaded = true
+	r.store = Store{Data: make(map[string]string)}
+	sessionID, err := ReadCookie(r.c)
+	if err != nil {
+		return
+	}
+	sessionStore, err := r.provider.LoadStore(sessionID)
+	if err != nil {
+		r.c.Echo().Logger.Debugf("Session Load Error. [%s]", err)
+		return
+	}
+	if sessionStore.Data == nil {
+		sessionStore.Data = make(map[string]string)
+	}
+	r.valid = true
+	r.id = sessionID
+	r.store = sessionStore
+	if resealer, ok := r.provider.(Resealer); ok && needsRefresh(sessionStore, time.Now()) {
+		r.refresh(resealer)
+	}
+}
+
+// 保存し直して有効期限を延長し、新しいセッションIDをCookieに書き込む
+// （失敗しても、読み出したセッションをそのまま使用する）
+func (r *Request) refresh(resealer Resealer) {
+	sessionID, err := resealer.Reseal(r.id, r.store)
+	if err == nil {
+		err = r.switchTo(sessionID)
+	}
+	if err != nil {
+		r.c.Echo().Logger.Debugf("Session Refresh Error. [%s]", err)
+	}
+}
+
+// Valid は 有効なセッションがあるかを返します。
+func (r *Request) Valid() bool {
+	r.load()
+	return r.valid
+}
+
+// ID は セッションIDを返します。
+func (r *Request) ID() ID {
+	r.load()
+	return r.id
+}
+
+// Expire は セッションの有効期限を返します。
+func (r *Request) Expire() time.Time {
+	r.load()
+	return r.store.Expire
+}
+
+// ExpiresWithin は セッションの有効期限が d 以内に切れるかを返します。
+func (r *Request) ExpiresWithin(d time.Duration) bool {
+	r.load()
+	return r.valid && r.store.ExpiresWithin(d)
+}
+
+// Value は データストアの値を返します。
+func (r *Request) Value(key string) (string, bool) {
+	r.load()
+	value, ok := r.store.Data[key]
+	return value, ok
+}
+
+// SetValue は データストアに値を設定します。
+func (r *Request) SetValue(key string, value string) {
+	r.load()
+	r.store.Data[key] = value
+	r.changed[key] = struct{}{}
+}
+
+// DeleteValue は データストアから値を削除します。
+func (r *Request) DeleteValue(key string) {
+	r.load()
+	delete(r.store.Data, key)
+	r.changed[key] = struct{}{}
+}
+
+// Clear は データストアの値を全て削除します。
+// CSRFトークンは表示中の画面のフォームで使用されるため、削除せずに引き継ぎます。
+func (r *Request) Clear() {
+	r.load()
+	token, ok := r.store.Data[csrfKey]
+	r.store.Data = make(map[string]string)
+	r.changed = make(map[string]struct{})
+	r.cleared = true
+	if ok {
+		r.SetValue(csrfKey, token)
+	}
+}
+
+// Get は データストアの値を登録された方式で変換し、v（ポインタ）に読み出します。
+func (r *Request) Get(key string, v interface{}) error {
+	r.load()
+	return r.store.Get(key, v)
+}
+
+// Set は 値を登録された方式で変換し、データストアに設定します。
+func (r *Request) Set(key string, v interface{}) error {
+	r.load()
+	if err := r.store.Set(key, v); err != nil {
+		return err
+	}
+	r.changed[key] = struct{}{}
+	return nil
+}
+
+// Create は 新しいセッションを作成してCookieに書き込みます。
+// 保存していない変更は、新しいセッションに引き継ぎます。
+func (r *Request) Create() error {
+	r.load()
+	sessionID, err := r.provider.Create()
+	if err != nil {
+		return err
+	}
+	return r.switchTo(sessionID)
+}
+
+// Regenerate は セッションIDを再発行してCookieに書き込みます。
+// 保存していない変更は、新しいセッションIDに引き継ぎます。
+func (r *Request) Regenerate() error {
+	r.load()
+	if !r.valid {
+		return ErrorNotFound
+	}
+	sessionID, err := r.provider.Regenerate(r.id)
+	if err != nil {
+		return err
+	}
+	return r.switchTo(sessionID)
+}
+
+// Authenticate は セッションをユーザーのログインが完了した状態にします。
+// 保存していない変更を保存してから、Provider が Authenticator の場合は
+// 同時にログインできるセッション数の上限（limit、0以下の場合は無制限）の確認と
+// ログインの完了をまとめて行い、終了させたセッションの一覧を返します。
+// 上限に達している場合は、evict なら作成日時の古いセッションを終了させ、
+// そうでなければ ErrorLimitExceeded を返します。
+// Authenticator でない Provider では上限を確認できないため、limit が0より
+// 大きい場合は ErrorNotImplemented を返します。
+func (r *Request) Authenticate(userID string, limit int, evict bool) ([]Info, error) {
+	r.load()
+	authenticator, ok := r.provider.(Authenticator)
+	if !ok {
+		if limit > 0 {
+			return nil, ErrorNotImplemented
+		}
+		r.SetValue(UserIDKey, userID)
+		r.SetValue(AuthStateKey, AuthStateAuthenticated)
+		return nil, r.Save()
+	}
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+	if !r.valid {
+		return nil, ErrorNotFound
+	}
+	evicted, err := authenticator.Authenticate(r.id, userID, limit, evict)
+	if err != nil {
+		return nil, err
+	}
+	r.store.Data[UserIDKey] = userID
+	r.store.Data[AuthStateKey] = AuthStateAuthenticated
+	return evicted, nil
+}
+
+// 新しいセッションIDに切り替え、保存していない変更を適用し直す
+func (r *Request) switchTo(sessionID ID) error {
+	if err := WriteCookie(r.c, sessionID); err != nil {
+		return err
+	}
+	sessionStore, err := r.provider.LoadStore(sessionID)
+	if err != nil {
+		return err
+	}
+	if sessionStore.Data == nil {
+		sessionStore.Data = make(map[string]string)
+	}
+	r.apply(&sessionStore)
+	r.valid = true
+	r.id = sessionID
+	r.store = sessionStore
+	return nil
+}
+
+// 保存していない変更をデータストアに適用する
+func (r *Request) apply(sessionStore *Store) {
+	if r.cleared {
+		sessionStore.Data = make(map[string]string)
+	}
+	for key := range r.changed {
+		if value, ok := r.store.Data[key]; ok {
+			sessionStore.Data[key] = value
+		} else {
+			delete(sessionStore.Data, key)
+		}
+	}
+}
+
+// Save は 変更を保存します。変更していない場合は何もしません。
+// 有効なセッションが無い場合は、新しく作成してから保存します。
+// 他のリクエストが同時に変更した値は、このリクエストで変更した値以外は残ります。
+func (r *Request) Save() error {
+	if !r.loaded || (!r.cleared && len(r.changed) == 0) {
+		return nil
+	}
+	if !r.valid {
+		if len(r.changed) == 0 {
+			return nil
+		}
+		if err := r.Create(); err != nil {
+			return err
+		}
+	}
+	if resealer, ok := r.provider.(Resealer); ok {
+		// 保存するとIDが変わるため、同じリクエストで再度保存できるよう新しいIDに切り替える
+		sessionStore, err := r.provider.LoadStore(r.id)
+		if err != nil {
+			return err
+		}
+		if sessionStore.Data == nil {
+			sessionStore.Data = make(map[string]string)
+		}
+		r.apply(&sessionStore)
+		sessionID, err := resealer.Reseal(r.id, sessionStore)
+		if err != nil {
+			return err
+		}
+		r.cleared = false
+		r.changed = make(map[string]struct{})
+		return r.switchTo(sessionID)
+	}
+	saver, ok := r.provider.(Saver)
+	if !ok {
+		return ErrorNotImplemented
+	}
+	err := saver.Update(r.id, func(sessionStore *Store) error {
+		if sessionStore.Data == nil {
+			sessionStore.Data = make(map[string]string)
+		}
+		r.apply(sessionStore)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.cleared = false
+	r.changed = make(map[string]struct{})
+	return nil
+}
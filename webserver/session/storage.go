@@ -0,0 +1,143 @@
+package session
+
+import (
+	"encoding/json"
+	"time"
+
+	"../setting"
+)
+
+// セッションを保存するストレージのインターフェース
+// Manager のメインループからのみ呼び出されるため、実装側で排他制御は不要です。
+type storage interface {
+	// ストレージを開く
+	Open() error
+	// ストレージを閉じる
+	Close() error
+	// fn の中の操作をまとめて行う
+	// 複数のWebサーバーで共有するストレージでは、fn の中で読み出したセッション・一覧が
+	// 他のWebサーバーから変更されていた場合、fn の中の変更を破棄して最初からやり直す
+	// （fn はストレージ以外の状態を変更しないこと）
+	Transaction(fn func(tx storageTx) error) error
+	// 有効期限が now より前のセッションを全て削除する
+	DeleteExpired(now time.Time) error
+	// 全てのセッションについて fn を呼び出す（期限切れのセッションを含む場合がある）
+	ForEach(fn func(id ID, s session) error) error
+	// ストレージ自身が期限切れのセッションを削除するか
+	// （true の場合はGCを行わない）
+	ExpiresNatively() bool
+}
+
+// storage.Transaction の中で行うセッションの操作
+type storageTx interface {
+	// セッションを読み出す（存在しない場合は false を返す）
+	Get(id ID) (session, bool, error)
+	// セッションを保存する（同じIDのセッションが存在する場合は上書きする）
+	// データストアの UserIDKey の値で、ユーザー毎のセッションの一覧も更新する
+	Put(id ID, s session) error
+	// セッションを削除する
+	Delete(id ID) error
+	// ユーザーのセッションのIDの一覧を返す
+	// （期限切れ・削除済みのセッションを含む場合があるため、読み出して確認すること）
+	UserSessions(userID string) ([]ID, error)
+}
+
+// ストレージの種別
+const (
+	StorageMemory = "memory" // メモリ上（再起動するとセッションは消える）
+	StorageBolt   = "bolt"   // bbolt（組み込みKey/Valueストア）のファイル
+	StorageRedis  = "redis"  // Redisプロトコルで通信するサーバー
+	StorageCookie = "cookie" // サーバー側には保存せず、暗号化してCookieに保存する（CookieManager）
+)
+
+// 設定に応じたストレージを生成する
+func newStorage() (storage, error) {
+	switch setting.Session.Storage {
+	case StorageMemory, "":
+		return &memoryStorage{}, nil
+	case StorageBolt:
+		return &boltStorage{path: setting.Session.StoragePath}, nil
+	case StorageRedis:
+		return &redisStorage{
+			address:   setting.Session.RedisAddress,
+			password:  setting.Session.RedisPassword,
+			database:  setting.Session.RedisDatabase,
+			keyPrefix: setting.Session.RedisKeyPrefix,
+		}, nil
+	}
+	return nil, ErrorBadParameter
+}
+
+// bbolt・Redisに保存する際のセッションの形式
+type sessionRecord struct {
+	Data             map[string]string `json:"data"`
+	ConsistencyToken string            `json:"consistency_token"`
+	Created          time.Time         `json:"created"`
+	Expire           time.Time         `json:"expire"`
+	LastAccess       time.Time         `json:"last_access"`
+	IP               string            `json:"ip"`
+	UserAgent        string            `json:"user_agent"`
+}
+
+// セッションを保存する形式に変換する
+func encodeRecord(x session) ([]byte, error) {
+	record := sessionRecord{x.store.Data, x.store.ConsistencyToken, x.created, x.expire, x.lastAccess, x.ip, x.userAgent}
+	return json.Marshal(record)
+}
+
+// 保存した形式からセッションに戻す
+func decodeRecord(v []byte) (session, error) {
+	var x session
+	record := sessionRecord{}
+	if err := json.Unmarshal(v, &record); err != nil {
+		return x, err
+	}
+	x.store = Store{Data: record.Data, ConsistencyToken: record.ConsistencyToken}
+	x.created = record.Created
+	x.expire = record.Expire
+	x.lastAccess = record.LastAccess
+	x.ip = record.IP
+	x.userAgent = record.UserAgent
+	return x, nil
+}
+
+// ユーザー毎のセッションのインデックス（memory・bolt で使用する）
+type userIndex struct {
+	owners   map[ID]string
+	sessions map[string]map[ID]struct{}
+}
+
+func newUserIndex() userIndex {
+	return userIndex{make(map[ID]string), make(map[string]map[ID]struct{})}
+}
+
+// セッションを所有するユーザーを更新する（userIDが空の場合はインデックスから除く）
+func (x userIndex) set(id ID, userID string) {
+	if oldUserID, ok := x.owners[id]; ok {
+		if oldUserID == userID {
+			return
+		}
+		delete(x.sessions[oldUserID], id)
+		if len(x.sessions[oldUserID]) == 0 {
+			delete(x.sessions, oldUserID)
+		}
+		delete(x.owners, id)
+	}
+	if userID == "" {
+		return
+	}
+	x.owners[id] = userID
+	if x.sessions[userID] == nil {
+		x.sessions[userID] = make(map[ID]struct{})
+	}
+	x.sessions[userID][id] = struct{}{}
+}
+
+// ユーザーのセッションのIDの一覧
+func (x userIndex) list(userID string) []ID {
+	ids := make([]ID, 0, len(x.sessions[userID]))
+	for id := range x.sessions[userID] {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,172 @@
+package session
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// セッションを保存するバケット名
+var boltSessionsBucket = []byte("sessions")
+
+// bbolt（組み込みKey/Valueストア）のファイルを使用するストレージ
+// サーバーを再起動してもセッションが維持されます。
+type boltStorage struct {
+	path  string
+	db    *bolt.DB
+	index userIndex
+}
+
+func (s *boltStorage) Open() error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	// ユーザー毎のセッションのインデックスを作成する
+	s.index = newUserIndex()
+	err = s.ForEach(func(id ID, x session) error {
+		s.index.set(id, x.store.Data[UserIDKey])
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStorage) ExpiresNatively() bool {
+	return false
+}
+
+// Transaction は fn の中の読み出し・変更を1つの bbolt のトランザクションで行います。
+// fn がエラーを返した場合は、変更を全て取り消します。
+// ユーザー毎のセッションのインデックスは、コミットできた場合のみ更新します。
+func (s *boltStorage) Transaction(fn func(tx storageTx) error) error {
+	owners := make(map[ID]string)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{s, tx.Bucket(boltSessionsBucket), owners})
+	})
+	if err != nil {
+		return err
+	}
+	for id, userID := range owners {
+		s.index.set(id, userID)
+	}
+	return nil
+}
+
+// bbolt のトランザクション中の操作
+type boltTx struct {
+	s      *boltStorage
+	bucket *bolt.Bucket
+	owners map[ID]string // コミット後にインデックスに反映するセッションの所有者（削除は空文字列）
+}
+
+func (tx *boltTx) Get(id ID) (session, bool, error) {
+	v := tx.bucket.Get([]byte(id))
+	if v == nil {
+		return session{}, false, nil
+	}
+	x, err := decodeRecord(v)
+	if err != nil {
+		return session{}, false, err
+	}
+	return x, true, nil
+}
+
+func (tx *boltTx) Put(id ID, x session) error {
+	v, err := encodeRecord(x)
+	if err != nil {
+		return err
+	}
+	if err := tx.bucket.Put([]byte(id), v); err != nil {
+		return err
+	}
+	tx.owners[id] = x.store.Data[UserIDKey]
+	return nil
+}
+
+func (tx *boltTx) Delete(id ID) error {
+	if err := tx.bucket.Delete([]byte(id)); err != nil {
+		return err
+	}
+	tx.owners[id] = ""
+	return nil
+}
+
+// インデックスの一覧に、このトランザクションでの変更を反映して返す
+func (tx *boltTx) UserSessions(userID string) ([]ID, error) {
+	ids := []ID{}
+	for _, id := range tx.s.index.list(userID) {
+		if owner, ok := tx.owners[id]; !ok || owner == userID {
+			ids = append(ids, id)
+		}
+	}
+	for id, owner := range tx.owners {
+		if owner == userID && tx.s.index.owners[id] != userID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *boltStorage) DeleteExpired(now time.Time) error {
+	expired := [][]byte{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSessionsBucket)
+		// カーソルで走査しながら削除すると要素を読み飛ばすことがあるため、
+		// 削除するキーを集めてから削除する
+		err := b.ForEach(func(k, v []byte) error {
+			record := sessionRecord{}
+			if err := json.Unmarshal(v, &record); err != nil || now.After(record.Expire) {
+				e.Logger.Debugf("Session[%s] expire delete. expire[%s]", k, record.Expire)
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		s.index.set(ID(k), "")
+	}
+	return nil
+}
+
+func (s *boltStorage) ForEach(fn func(id ID, x session) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionsBucket).ForEach(func(k, v []byte) error {
+			x, err := decodeRecord(v)
+			if err != nil {
+				// 読み出せないセッションは期限切れとしてGCで削除する
+				return nil
+			}
+			return fn(ID(k), x)
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package session
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Transaction の fn がエラーを返した場合は、セッションもユーザー毎の一覧も変更されないことを確認する
+func TestBoltStorageTransactionRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_bolt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setEcho(echo.New())
+	s := &boltStorage{path: filepath.Join(dir, "sessions.db")}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	x := session{
+		store:  Store{Data: map[string]string{UserIDKey: "alice"}, ConsistencyToken: createToken()},
+		expire: time.Now().Add(time.Minute),
+	}
+	errAbort := errors.New("abort")
+	err = s.Transaction(func(tx storageTx) error {
+		if err := tx.Put("s1", x); err != nil {
+			return err
+		}
+		// 同じトランザクションの中では変更が見える
+		if ids, _ := tx.UserSessions("alice"); len(ids) != 1 {
+			t.Errorf("UserSessions(alice) in tx = %v, want [s1]", ids)
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Transaction() = %v, want errAbort", err)
+	}
+	err = s.Transaction(func(tx storageTx) error {
+		if _, found, err := tx.Get("s1"); err != nil || found {
+			t.Errorf("Get(s1) = %v, %v, want not found", found, err)
+		}
+		if ids, _ := tx.UserSessions("alice"); len(ids) != 0 {
+			t.Errorf("UserSessions(alice) = %v, want none", ids)
+		}
+		return tx.Put("s1", x)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := s.index.list("alice"); len(ids) != 1 || ids[0] != "s1" {
+		t.Fatalf("index of alice = %v, want [s1]", ids)
+	}
+}
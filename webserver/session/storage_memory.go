@@ -0,0 +1,71 @@
+package session
+
+import (
+	"time"
+)
+
+// メモリ上のmapを使用するストレージ
+type memoryStorage struct {
+	sessions map[ID]session
+	index    userIndex
+}
+
+func (s *memoryStorage) Open() error {
+	s.sessions = make(map[ID]session)
+	s.index = newUserIndex()
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+func (s *memoryStorage) ExpiresNatively() bool {
+	return false
+}
+
+// メインループから順に呼び出されるため、そのまま実行する
+func (s *memoryStorage) Transaction(fn func(tx storageTx) error) error {
+	return fn(s)
+}
+
+func (s *memoryStorage) Get(id ID) (session, bool, error) {
+	x, ok := s.sessions[id]
+	return x, ok, nil
+}
+
+func (s *memoryStorage) Put(id ID, x session) error {
+	s.sessions[id] = x
+	s.index.set(id, x.store.Data[UserIDKey])
+	return nil
+}
+
+func (s *memoryStorage) Delete(id ID) error {
+	delete(s.sessions, id)
+	s.index.set(id, "")
+	return nil
+}
+
+func (s *memoryStorage) UserSessions(userID string) ([]ID, error) {
+	return s.index.list(userID), nil
+}
+
+func (s *memoryStorage) DeleteExpired(now time.Time) error {
+	for k, v := range s.sessions {
+		if now.After(v.expire) {
+			e.Logger.Debugf("Session[%s] expire delete. expire[%s]", k, v.expire)
+			delete(s.sessions, k)
+			s.index.set(k, "")
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) ForEach(fn func(id ID, x session) error) error {
+	for k, v := range s.sessions {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
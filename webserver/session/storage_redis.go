@@ -0,0 +1,303 @@
+package session
+
+import (
+	"strings"
+	"time"
+
+	"../setting"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Redisプロトコルで通信するサーバーを使用するストレージ
+// 複数のWebサーバーでセッションを共有できます。
+// セッションの有効期限はキーのTTLで管理するため、GCは行いません。
+//
+// ユーザー毎のセッションの一覧は、ユーザー毎のSETとしてRedisに保存します。
+// Transaction の中で読み出したキーは WATCH で監視し、変更は MULTI/EXEC で
+// まとめて行うため、ConsistencyToken の確認や同時にログインできるセッション数の
+// 確認は、複数のWebサーバーから同時に行っても競合しません。
+type redisStorage struct {
+	address   string
+	password  string
+	database  int
+	keyPrefix string
+	pool      *redis.Pool
+}
+
+func (s *redisStorage) Open() error {
+	s.pool = &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.address,
+				redis.DialPassword(s.password),
+				redis.DialDatabase(s.database),
+				redis.DialConnectTimeout(5*time.Second))
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	// 接続できるか確認しておく
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		s.pool.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *redisStorage) Close() error {
+	return s.pool.Close()
+}
+
+func (s *redisStorage) ExpiresNatively() bool {
+	return true
+}
+
+// Transaction が競合した場合にやり直す回数
+const redisTxMaxRetries = 5
+
+// ユーザー毎のセッションの一覧のキーの接頭辞（keyPrefix の後に付ける）
+const redisUserKeyPrefix = "user:"
+
+// Transaction は fn の中で読み出したキーを監視し、fn の中の変更をまとめて保存します。
+// 他のWebサーバーが監視しているキーを変更した場合は、redisTxMaxRetries 回まで
+// 最初からやり直し、それでも競合する場合は ErrorInvalidToken を返します。
+func (s *redisStorage) Transaction(fn func(tx storageTx) error) error {
+	conn := s.pool.Get()
+	// 途中でエラーになった場合も、プールに戻す際に WATCH・MULTI は解除される
+	defer conn.Close()
+	for i := 0; i < redisTxMaxRetries; i++ {
+		tx := &redisTx{
+			s:       s,
+			conn:    conn,
+			owners:  make(map[ID]string),
+			pending: make(map[ID]*session),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		ok, err := tx.commit()
+		if err != nil || ok {
+			return err
+		}
+		e.Logger.Debugf("Session Transaction conflict. retry[%d]", i+1)
+	}
+	return ErrorInvalidToken
+}
+
+// Redisのトランザクション
+// 読み出しは WATCH してからすぐに行い、変更は commit まで溜めておく
+type redisTx struct {
+	s    *redisStorage
+	conn redis.Conn
+	// 読み出したセッションが一覧に含まれているユーザー
+	owners map[ID]string
+	// このトランザクションで変更したセッション（削除した場合は nil）
+	pending map[ID]*session
+	cmds    [][]interface{}
+}
+
+func (tx *redisTx) Get(id ID) (session, bool, error) {
+	if x, ok := tx.pending[id]; ok {
+		if x == nil {
+			return session{}, false, nil
+		}
+		return *x, true, nil
+	}
+	if _, err := tx.conn.Do("WATCH", tx.s.key(id)); err != nil {
+		return session{}, false, err
+	}
+	x, ok, err := tx.s.get(tx.conn, id)
+	if err != nil {
+		return x, false, err
+	}
+	if ok {
+		tx.owners[id] = x.store.Data[UserIDKey]
+	} else if _, known := tx.owners[id]; !known {
+		tx.owners[id] = ""
+	}
+	return x, ok, nil
+}
+
+func (tx *redisTx) Put(id ID, x session) error {
+	ttl := time.Until(x.expire)
+	if ttl <= 0 {
+		return tx.Delete(id)
+	}
+	oldUserID, err := tx.owner(id)
+	if err != nil {
+		return err
+	}
+	v, err := encodeRecord(x)
+	if err != nil {
+		return err
+	}
+	// 有効期限はミリ秒単位のTTLとして設定する
+	tx.cmds = append(tx.cmds, []interface{}{"SET", tx.s.key(id), v, "PX", int64(ttl / time.Millisecond)})
+	userID := x.store.Data[UserIDKey]
+	if oldUserID != "" && oldUserID != userID {
+		tx.cmds = append(tx.cmds, []interface{}{"SREM", tx.s.userKey(oldUserID), string(id)})
+	}
+	if userID != "" {
+		// 一覧のセッションは全て作成から AbsoluteTimeout 以内に期限切れになるため、
+		// 追加する度に一覧の有効期限を AbsoluteTimeout に延ばす
+		userKey := tx.s.userKey(userID)
+		tx.cmds = append(tx.cmds, []interface{}{"SADD", userKey, string(id)})
+		tx.cmds = append(tx.cmds, []interface{}{"PEXPIRE", userKey, int64(setting.Session.AbsoluteTimeout / time.Millisecond)})
+	}
+	tx.owners[id] = userID
+	tx.pending[id] = &x
+	return nil
+}
+
+func (tx *redisTx) Delete(id ID) error {
+	oldUserID, err := tx.owner(id)
+	if err != nil {
+		return err
+	}
+	tx.cmds = append(tx.cmds, []interface{}{"DEL", tx.s.key(id)})
+	if oldUserID != "" {
+		tx.cmds = append(tx.cmds, []interface{}{"SREM", tx.s.userKey(oldUserID), string(id)})
+	}
+	tx.owners[id] = ""
+	tx.pending[id] = nil
+	return nil
+}
+
+func (tx *redisTx) UserSessions(userID string) ([]ID, error) {
+	userKey := tx.s.userKey(userID)
+	if _, err := tx.conn.Do("WATCH", userKey); err != nil {
+		return nil, err
+	}
+	members, err := redis.Strings(tx.conn.Do("SMEMBERS", userKey))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ID, 0, len(members))
+	for _, x := range members {
+		id := ID(x)
+		// 期限切れのセッションを削除する際に、一覧からも除けるようにする
+		if _, known := tx.owners[id]; !known {
+			tx.owners[id] = userID
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// セッションが含まれている一覧のユーザー（読み出していない場合は読み出す）
+func (tx *redisTx) owner(id ID) (string, error) {
+	if userID, ok := tx.owners[id]; ok {
+		return userID, nil
+	}
+	if _, _, err := tx.Get(id); err != nil {
+		return "", err
+	}
+	return tx.owners[id], nil
+}
+
+// 溜めておいた変更を MULTI/EXEC でまとめて行う
+// 監視しているキーが変更されていた場合は false を返す
+func (tx *redisTx) commit() (bool, error) {
+	if len(tx.cmds) == 0 {
+		_, err := tx.conn.Do("UNWATCH")
+		return true, err
+	}
+	if err := tx.conn.Send("MULTI"); err != nil {
+		return false, err
+	}
+	for _, cmd := range tx.cmds {
+		if err := tx.conn.Send(cmd[0].(string), cmd[1:]...); err != nil {
+			return false, err
+		}
+	}
+	reply, err := tx.conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// セッションを読み出す
+func (s *redisStorage) get(conn redis.Conn, id ID) (session, bool, error) {
+	var x session
+	v, err := redis.Bytes(conn.Do("GET", s.key(id)))
+	if err == redis.ErrNil {
+		return x, false, nil
+	}
+	if err != nil {
+		return x, false, err
+	}
+	x, err = decodeRecord(v)
+	if err != nil {
+		return x, false, err
+	}
+	return x, true, nil
+}
+
+func (s *redisStorage) DeleteExpired(now time.Time) error {
+	// 期限切れのキーはRedisが削除する
+	// （ユーザー毎の一覧に残ったIDは、一覧を参照する際に取り除く）
+	return nil
+}
+
+func (s *redisStorage) ForEach(fn func(id ID, x session) error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	// KEYSはサーバーを止めてしまうため、SCANで少しずつ走査する
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", s.keyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			// ユーザー毎のセッションの一覧は除く
+			if strings.HasPrefix(key, s.keyPrefix+redisUserKeyPrefix) {
+				continue
+			}
+			v, err := redis.Bytes(conn.Do("GET", key))
+			if err == redis.ErrNil {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			x, err := decodeRecord(v)
+			if err != nil {
+				continue
+			}
+			if err := fn(ID(key[len(s.keyPrefix):]), x); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// セッションIDに対応するキー
+func (s *redisStorage) key(id ID) string {
+	return s.keyPrefix + string(id)
+}
+
+// ユーザーのセッションの一覧のキー
+func (s *redisStorage) userKey(userID string) string {
+	return s.keyPrefix + redisUserKeyPrefix + userID
+}
@@ -0,0 +1,332 @@
+package session
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"../setting"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+)
+
+// テスト用のRedisサーバーを起動し、セッションの保存先に設定する
+func startTestRedis(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting.Load()
+	setting.Session.Storage = StorageRedis
+	setting.Session.RedisAddress = mr.Addr()
+	// ストレージのみを使用するテストのログ出力先
+	setEcho(echo.New())
+	return mr
+}
+
+// 同じRedisサーバーを共有するWebサーバーの Manager を開始する
+func startTestManager(t *testing.T) *Manager {
+	m := &Manager{}
+	if err := m.Start(echo.New()); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func openTestRedisStorage(t *testing.T) *redisStorage {
+	s, err := newStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return s.(*redisStorage)
+}
+
+// ログインしたセッションを作成する
+func createTestLogin(t *testing.T, m *Manager, userID string) ID {
+	sessionID, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Authenticate(sessionID, userID, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	return sessionID
+}
+
+func TestRedisStorageTTL(t *testing.T) {
+	mr := startTestRedis(t)
+	defer mr.Close()
+	s := openTestRedisStorage(t)
+	defer s.Close()
+
+	now := time.Now()
+	x := session{
+		store:   Store{Data: map[string]string{UserIDKey: "alice"}, ConsistencyToken: createToken()},
+		created: now,
+		expire:  now.Add(time.Minute),
+	}
+	err := s.Transaction(func(tx storageTx) error {
+		return tx.Put("s1", x)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(s.key("s1")); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("session TTL = %s", ttl)
+	}
+	if ttl := mr.TTL(s.userKey("alice")); ttl != setting.Session.AbsoluteTimeout {
+		t.Fatalf("user index TTL = %s", ttl)
+	}
+
+	mr.FastForward(2 * time.Minute)
+	err = s.Transaction(func(tx storageTx) error {
+		if _, ok, err := tx.Get("s1"); err != nil || ok {
+			t.Errorf("expired session: ok=%v err=%v", ok, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisStorageTransactionRetry(t *testing.T) {
+	mr := startTestRedis(t)
+	defer mr.Close()
+	s := openTestRedisStorage(t)
+	defer s.Close()
+
+	now := time.Now()
+	x := session{
+		store:   Store{Data: map[string]string{"n": "0"}, ConsistencyToken: createToken()},
+		created: now,
+		expire:  now.Add(time.Minute),
+	}
+	if err := s.Transaction(func(tx storageTx) error { return tx.Put("s1", x) }); err != nil {
+		t.Fatal(err)
+	}
+	other, err := redis.Dial("tcp", mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	calls := 0
+	err = s.Transaction(func(tx storageTx) error {
+		calls++
+		x, _, err := tx.Get("s1")
+		if err != nil {
+			return err
+		}
+		if calls == 1 {
+			// 読み出した後に他のWebサーバーが変更する
+			changed := x
+			changed.store = Store{Data: map[string]string{"n": "other"}, ConsistencyToken: createToken()}
+			v, _ := encodeRecord(changed)
+			if _, err := other.Do("SET", s.key("s1"), v, "PX", 60000); err != nil {
+				return err
+			}
+		}
+		x.store.Data = map[string]string{"n": x.store.Data["n"] + "+1"}
+		return tx.Put("s1", x)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("calls = %d, want 2", calls)
+	}
+	s.Transaction(func(tx storageTx) error {
+		x, _, _ := tx.Get("s1")
+		if x.store.Data["n"] != "other+1" {
+			t.Errorf("n = %q, want %q", x.store.Data["n"], "other+1")
+		}
+		return nil
+	})
+}
+
+func TestManagerRedisConsistencyToken(t *testing.T) {
+	mr := startTestRedis(t)
+	defer mr.Close()
+	m1 := startTestManager(t)
+	defer m1.Stop()
+	m2 := startTestManager(t)
+	defer m2.Stop()
+
+	sessionID, err := m1.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store1, err := m1.LoadStore(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store2, err := m2.LoadStore(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store2.Data["a"] = "2"
+	if err := m2.SaveStore(sessionID, store2); err != nil {
+		t.Fatal(err)
+	}
+	store1.Data["a"] = "1"
+	if err := m1.SaveStore(sessionID, store1); err != ErrorInvalidToken {
+		t.Fatalf("SaveStore with old token: %v, want ErrorInvalidToken", err)
+	}
+	// Update は最新の内容で再試行する
+	err = m1.Update(sessionID, func(sessionStore *Store) error {
+		sessionStore.Data["b"] = "1"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionStore, err := m2.LoadStore(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionStore.Data["a"] != "2" || sessionStore.Data["b"] != "1" {
+		t.Fatalf("Data = %v", sessionStore.Data)
+	}
+}
+
+func TestManagerRedisDeleteByUser(t *testing.T) {
+	mr := startTestRedis(t)
+	defer mr.Close()
+	m1 := startTestManager(t)
+	defer m1.Stop()
+	m2 := startTestManager(t)
+	defer m2.Stop()
+
+	a1 := createTestLogin(t, m1, "alice")
+	a2 := createTestLogin(t, m1, "alice")
+	a3 := createTestLogin(t, m2, "alice")
+	b1 := createTestLogin(t, m1, "bob")
+
+	// 他のWebサーバーで作成したセッションも一覧に含まれる
+	infos, err := m2.ListByUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("ListByUser = %d sessions, want 3", len(infos))
+	}
+
+	if err := m2.DeleteAllExceptCurrent("alice", a3); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []ID{a1, a2} {
+		if _, err := m1.LoadStore(id); err != ErrorNotFound {
+			t.Fatalf("LoadStore after DeleteAllExceptCurrent: %v", err)
+		}
+	}
+	if _, err := m1.LoadStore(a3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m1.DeleteByUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m2.LoadStore(a3); err != ErrorNotFound {
+		t.Fatalf("LoadStore after DeleteByUser: %v", err)
+	}
+	if infos, _ := m2.ListByUser("alice"); len(infos) != 0 {
+		t.Fatalf("ListByUser after DeleteByUser = %d sessions", len(infos))
+	}
+	if _, err := m2.LoadStore(b1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerRedisExpiredSessionsLeaveIndex(t *testing.T) {
+	mr := startTestRedis(t)
+	defer mr.Close()
+	m := startTestManager(t)
+	defer m.Stop()
+	s := openTestRedisStorage(t)
+	defer s.Close()
+
+	createTestLogin(t, m, "alice")
+	// Redisのキーだけが期限切れになった状態にする
+	mr.FastForward(setting.Session.AbsoluteTimeout - time.Minute)
+	if infos, err := m.ListByUser("alice"); err != nil || len(infos) != 0 {
+		t.Fatalf("ListByUser = %v, %v", infos, err)
+	}
+	if mr.Exists(s.userKey("alice")) {
+		members, _ := mr.Members(s.userKey("alice"))
+		if len(members) != 0 {
+			t.Fatalf("user index members = %v", members)
+		}
+	}
+}
+
+func TestManagerRedisSessionLimit(t *testing.T) {
+	mr := startTestRedis(t)
+	defer mr.Close()
+	managers := []*Manager{startTestManager(t), startTestManager(t)}
+	defer managers[0].Stop()
+	defer managers[1].Stop()
+
+	// 2台のWebサーバーで同時にログインしても、上限を超えない
+	const n = 6
+	var wg sync.WaitGroup
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		m := managers[i%2]
+		sessionID, err := m.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Authenticate(sessionID, "alice", 2, false)
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	succeeded := 0
+	for err := range results {
+		switch err {
+		case nil:
+			succeeded++
+		case ErrorLimitExceeded:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if succeeded != 2 {
+		t.Fatalf("succeeded = %d, want 2", succeeded)
+	}
+
+	// 上限に達している場合は、古いセッションを終了させてログインできる
+	sessionID, err := managers[0].Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted, err := managers[0].Authenticate(sessionID, "alice", 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 1 {
+		t.Fatalf("evicted = %d sessions, want 1", len(evicted))
+	}
+	infos, err := managers[1].ListByUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticated := 0
+	for _, x := range infos {
+		if x.Data[AuthStateKey] == AuthStateAuthenticated {
+			authenticated++
+		}
+	}
+	if authenticated != 2 {
+		t.Fatalf("authenticated sessions = %d, want 2", authenticated)
+	}
+}
@@ -1,6 +1,9 @@
 package setting
 
 import (
+	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -8,23 +11,143 @@ import (
 var Server = server{}
 
 type server struct {
-	Port string
+	Port           string
+	TrustedProxies []string
 }
 
 // Session はセッションに関する設定です。
 var Session = session{}
 
 type session struct {
-	CookieName   string
-	CookieExpire time.Duration
+	CookieName      string
+	CookieExpire    time.Duration
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	ExpireWarning   time.Duration
+	CookiePrefix    string
+	CookiePath      string
+	CookieDomain    string
+	CookieSecure    bool
+	CookieHTTPOnly  bool
+	CookieSameSite  http.SameSite
+	Storage         string
+	StoragePath     string
+	RedisAddress    string
+	RedisPassword   string
+	RedisDatabase   int
+	RedisKeyPrefix  string
+	CookieKeys      []string
+}
+
+// UserData はユーザー情報の保存に関する設定です。
+var UserData = userData{}
+
+type userData struct {
+	Backend     string
+	FilePath    string
+	BackupCount int
+	BoltPath    string
+}
+
+// Login はログインの試行回数制限・ログインの保持に関する設定です。
+var Login = login{}
+
+type login struct {
+	UserMaxFailures int
+	IPMaxFailures   int
+	LockoutBase     time.Duration
+	LockoutMax      time.Duration
+	FailureWindow   time.Duration
+	TOTPIssuer      string
+	RememberCookie  string
+	RememberExpire  time.Duration
+	MaxSessions     map[string]int
+	SessionLimit    string
+}
+
+// Password はパスワードポリシーに関する設定です。
+var Password = password{}
+
+type password struct {
+	MinLength      int
+	BannedListFile string
 }
 
 // Load は設定を読み込みます。
 func Load() {
 	// ポート番号
 	Server.Port = ":3000"
+	// 信頼するリバースプロキシのIPアドレス（CIDR表記も可）
+	// このアドレスからの接続の場合のみ、X-Forwarded-For ヘッダーから接続元のIPアドレスを求める
+	Server.TrustedProxies = []string{}
 	// セッションのCookie名
 	Session.CookieName = "gowebserver_session_id"
-	// セッションのCookie有効期限
-	Session.CookieExpire = (1 * time.Hour)
+	// セッションの有効期限（最後のアクセスからの時間）
+	Session.IdleTimeout = (30 * time.Minute)
+	// セッションの最長有効期間（作成からの時間、アクセスがあっても延長しない）
+	Session.AbsoluteTimeout = (8 * time.Hour)
+	// セッションの有効期限が近いことを画面に表示し始める時間
+	Session.ExpireWarning = (10 * time.Minute)
+	// セッションのCookie有効期限（セッションの最長有効期間に合わせる）
+	Session.CookieExpire = Session.AbsoluteTimeout
+	// セッションのCookie名の接頭辞（""、"__Secure-" または "__Host-"）
+	// 接頭辞を付けた場合はSecure属性が必須になるため、HTTPSで運用してください
+	Session.CookiePrefix = ""
+	// セッションのCookieのPath属性・Domain属性
+	Session.CookiePath = "/"
+	Session.CookieDomain = ""
+	// セッションのCookieをHTTPSの場合のみ送信する（Secure属性）
+	Session.CookieSecure = false
+	// セッションのCookieをJavaScriptから参照させない（HttpOnly属性）
+	Session.CookieHTTPOnly = true
+	// セッションのCookieを他サイトからのリクエストで送信するか（SameSite属性）
+	Session.CookieSameSite = http.SameSiteLaxMode
+	// セッションの保存先（"memory"、"bolt"、"redis" または "cookie"）
+	Session.Storage = "memory"
+	// セッションを保存するbboltデータベースファイル
+	Session.StoragePath = "data/sessions.db"
+	// セッションを保存するRedisサーバーのアドレス・パスワード・DB番号
+	Session.RedisAddress = "localhost:6379"
+	Session.RedisPassword = ""
+	Session.RedisDatabase = 0
+	// Redisに保存する際のキーの接頭辞
+	Session.RedisKeyPrefix = "gowebserver:session:"
+	// Storageが"cookie"の場合にセッションを暗号化する鍵（Base64エンコードした32バイト）
+	// 空白区切りで複数指定でき、先頭の鍵で暗号化する
+	Session.CookieKeys = strings.Fields(os.Getenv("GOWEBSERVER_SESSION_KEYS"))
+	// ユーザー情報の保存先（"json" または "bolt"）
+	UserData.Backend = "json"
+	// ユーザー情報のJSONファイル
+	UserData.FilePath = "data/users.json"
+	// ユーザー情報のJSONファイルのバックアップ世代数
+	UserData.BackupCount = 3
+	// ユーザー情報のbboltデータベースファイル
+	// （初回起動時はFilePathのJSONファイルの内容を取り込む）
+	UserData.BoltPath = "data/users.db"
+	// ユーザーIDをロックするまでの連続ログイン失敗回数
+	Login.UserMaxFailures = 5
+	// IPアドレスをロックするまでの連続ログイン失敗回数
+	Login.IPMaxFailures = 20
+	// 最初のロック時間（以降、失敗する度に倍になる）
+	Login.LockoutBase = (1 * time.Minute)
+	// ロック時間の上限
+	Login.LockoutMax = (1 * time.Hour)
+	// 最後の失敗からこの時間が経過したら失敗回数をリセットする
+	Login.FailureWindow = (15 * time.Minute)
+	// 二段階認証（TOTP）の認証アプリに表示する発行者名
+	Login.TOTPIssuer = "Go Website Sample"
+	// ログインしたままにするトークンのCookie名（属性はセッションのCookieと同じ）
+	Login.RememberCookie = "gowebserver_remember"
+	// ログインしたままにする期間（使用する度に延長する）
+	Login.RememberExpire = (30 * 24 * time.Hour)
+	// 同時にログインできるセッション数の上限（権限毎、0または未指定の場合は無制限）
+	// 複数の権限を持つユーザーには最も小さい上限を適用する
+	// Session.Storageが"cookie"の場合はセッションの一覧を持たないため、全て0にしてください
+	Login.MaxSessions = map[string]int{"admin": 1, "user": 5}
+	// 上限を超えた場合の動作（"evict": 最も古いセッションを終了させる、"refuse": ログインを拒否する）
+	Login.SessionLimit = "evict"
+	// パスワードの最小文字数
+	Password.MinLength = 10
+	// 使用を禁止するパスワードの一覧ファイル
+	Password.BannedListFile = "data/banned_passwords.txt"
 }
@@ -4,6 +4,7 @@ import (
 	"html/template"
 	"io"
 
+	"./session"
 	"github.com/labstack/echo"
 )
 
@@ -12,12 +13,49 @@ type Template struct {
 }
 
 // Render はHTMLテンプレートにデータを埋め込んだ結果をWriterに書き込みます。
+// テンプレート関数は、リクエスト毎の値を参照するものに置き換えてから実行します。
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	if t, ok := templates[name]; ok {
-		return t.ExecuteTemplate(w, "layout.html", data)
+	tmpl, ok := templates[name]
+	if !ok {
+		c.Echo().Logger.Debugf("Template[%s] Not Found.", name)
+		tmpl = templates["error"]
+		data = "Internal Server Error"
 	}
-	c.Echo().Logger.Debugf("Template[%s] Not Found.", name)
-	return templates["error"].ExecuteTemplate(w, "layout.html", "Internal Server Error")
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	tmpl.Funcs(requestFuncs(c))
+	return tmpl.ExecuteTemplate(w, "layout.html", data)
+}
+
+// 全てのテンプレートで使用できる関数
+// （読み込み時は仮の関数を登録し、Render でリクエスト毎の関数に置き換える）
+var templateFuncs = template.FuncMap{
+	"flashes":   func() []session.Flash { return nil },
+	"csrfField": func() (template.HTML, error) { return "", nil },
+}
+
+// リクエスト毎のテンプレート関数
+func requestFuncs(c echo.Context) template.FuncMap {
+	return template.FuncMap{
+		// 表示するフラッシュメッセージを取り出す
+		"flashes": func() []session.Flash {
+			if sessionRequest := session.FromContext(c); sessionRequest != nil {
+				return sessionRequest.Flashes()
+			}
+			return nil
+		},
+		// フォームに埋め込むCSRFトークンの hidden 項目
+		"csrfField": func() (template.HTML, error) {
+			return csrfField(c)
+		},
+	}
+}
+
+// 共通レイアウトのテンプレートを生成する
+func newTemplate() *template.Template {
+	return template.New("layout.html").Funcs(templateFuncs)
 }
 
 // HTMLテンプレートの読み込み
@@ -26,15 +64,25 @@ func loadTemplates() {
 	templates = make(map[string]*template.Template)
 	// 各HTMLテンプレートに共通レイアウトを適用した結果をmapに保存する
 	templates["index"] = template.Must(
-		template.ParseFiles(baseTemplate, "templates/index.html"))
+		newTemplate().ParseFiles(baseTemplate, "templates/index.html"))
 	templates["error"] = template.Must(
-		template.ParseFiles(baseTemplate, "templates/error.html"))
+		newTemplate().ParseFiles(baseTemplate, "templates/error.html"))
 	templates["user"] = template.Must(
-		template.ParseFiles(baseTemplate, "templates/user.html"))
+		newTemplate().ParseFiles(baseTemplate, "templates/user.html"))
+	templates["user_password"] = template.Must(
+		newTemplate().ParseFiles(baseTemplate, "templates/user_password.html"))
+	templates["user_totp"] = template.Must(
+		newTemplate().ParseFiles(baseTemplate, "templates/user_totp.html"))
 	templates["login"] = template.Must(
-		template.ParseFiles(baseTemplate, "templates/login.html"))
+		newTemplate().ParseFiles(baseTemplate, "templates/login.html"))
+	templates["login_totp"] = template.Must(
+		newTemplate().ParseFiles(baseTemplate, "templates/login_totp.html"))
 	templates["admin"] = template.Must(
-		template.ParseFiles(baseTemplate, "templates/admin.html"))
+		newTemplate().ParseFiles(baseTemplate, "templates/admin.html"))
 	templates["admin_users"] = template.Must(
-		template.ParseFiles(baseTemplate, "templates/admin_users.html"))
+		newTemplate().ParseFiles(baseTemplate, "templates/admin_users.html"))
+	templates["admin_sessions"] = template.Must(
+		newTemplate().ParseFiles(baseTemplate, "templates/admin_sessions.html"))
+	templates["admin_user_sessions"] = template.Must(
+		newTemplate().ParseFiles(baseTemplate, "templates/admin_user_sessions.html"))
 }